@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dinifarb/mlog"
+	"github.com/dinifarb/queuic/pkg/proto"
+	"github.com/dinifarb/queuic/pkg/queue"
+	"github.com/dinifarb/queuic/pkg/server"
+)
+
+const (
+	DEFAULT_HTTP_ADDRESS = ":8080"
+	DEFAULT_LOG_LEVEL    = "info"
+	DEFAULT_KEY          = "QUEUEIC"
+)
+
+// Config is the configuration of the broker. It is read from the json
+// file of -config or QUEUEIC_CONFIG, the env variables override the
+// file and the flags override both.
+type Config struct {
+	// Port is the udp port of the broker
+	Port int `json:"port"`
+	// BindAddress is the ip the broker receives on, all if empty
+	BindAddress string `json:"bind_address"`
+	// HTTPAddress is the address of the http interface, e.g. :8080
+	HTTPAddress string `json:"http_address"`
+	DataDir     string `json:"data_dir"`
+	// LogLevel is one of error, warn, info, debug and trace
+	LogLevel string `json:"log_level"`
+	Key      string `json:"key"`
+	// OTLPEndpoint is the url the spans are exported to, no export if empty
+	OTLPEndpoint    string   `json:"otlp_endpoint"`
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+	// Workers handle the requests, Backlog requests wait for
+	// a worker before further ones are answered with ERR_BUSY
+	Workers int `json:"workers"`
+	Backlog int `json:"backlog"`
+	// QueueDefaults are the options of queues created without options
+	QueueDefaults QueueConfig        `json:"queue_defaults"`
+	AutoCreate    []AutoCreateConfig `json:"auto_create"`
+	// Queues are created or updated to their options on start
+	Queues []QueueDefinitionConfig `json:"queues"`
+}
+
+// QueueConfig are the options of a queue in the config file
+type QueueConfig struct {
+	MaxLength  int      `json:"max_length"`
+	TTL        Duration `json:"ttl"`
+	DeadLetter string   `json:"dead_letter"`
+}
+
+// AutoCreateConfig creates the queues whose name matches the pattern
+type AutoCreateConfig struct {
+	Pattern string `json:"pattern"`
+	QueueConfig
+}
+
+// QueueDefinitionConfig declares a queue in the config file
+type QueueDefinitionConfig struct {
+	Name string `json:"name"`
+	QueueConfig
+}
+
+// Duration is a time.Duration written like 1h30m in json
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	duration, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+func defaultConfig() Config {
+	return Config{
+		Port:            server.DEFAULT_PORT,
+		HTTPAddress:     DEFAULT_HTTP_ADDRESS,
+		DataDir:         queue.DEFAULT_DATA_DIR,
+		LogLevel:        DEFAULT_LOG_LEVEL,
+		Key:             DEFAULT_KEY,
+		ShutdownTimeout: Duration(SHUTDOWN_TIMEOUT),
+		Workers:         server.DEFAULT_WORKERS,
+		Backlog:         server.DEFAULT_BACKLOG,
+	}
+}
+
+// loadConfig reads the config file, the env variables and the flags in args
+func loadConfig(args []string, getenv func(string) string) (Config, error) {
+	cfg := defaultConfig()
+	flags := flag.NewFlagSet("queueic", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	file := flags.String("config", getenv("QUEUEIC_CONFIG"), "json config file, defaults to QUEUEIC_CONFIG")
+	var set Config
+	flags.IntVar(&set.Port, "port", 0, "udp port")
+	flags.StringVar(&set.BindAddress, "bind", "", "ip to receive on")
+	flags.StringVar(&set.HTTPAddress, "http", "", "address of the http interface")
+	flags.StringVar(&set.DataDir, "data-dir", "", "directory of the queue files")
+	flags.StringVar(&set.LogLevel, "log-level", "", "error, warn, info, debug or trace")
+	flags.StringVar(&set.OTLPEndpoint, "otlp-endpoint", "", "url to export spans to")
+	flags.IntVar(&set.Workers, "workers", 0, "count of workers which handle the requests")
+	flags.IntVar(&set.Backlog, "backlog", 0, "count of requests which wait for a worker")
+	if err := flags.Parse(args); err != nil {
+		return cfg, fmt.Errorf("%v\n%s", err, usage(flags))
+	}
+	if *file != "" {
+		if err := readConfigFile(*file, &cfg); err != nil {
+			return cfg, err
+		}
+	}
+	if err := applyEnv(&cfg, getenv); err != nil {
+		return cfg, err
+	}
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			cfg.Port = set.Port
+		case "bind":
+			cfg.BindAddress = set.BindAddress
+		case "http":
+			cfg.HTTPAddress = set.HTTPAddress
+		case "data-dir":
+			cfg.DataDir = set.DataDir
+		case "log-level":
+			cfg.LogLevel = set.LogLevel
+		case "otlp-endpoint":
+			cfg.OTLPEndpoint = set.OTLPEndpoint
+		case "workers":
+			cfg.Workers = set.Workers
+		case "backlog":
+			cfg.Backlog = set.Backlog
+		}
+	})
+	return cfg, cfg.validate()
+}
+
+func usage(flags *flag.FlagSet) string {
+	var b strings.Builder
+	b.WriteString("usage of queueic:\n")
+	flags.SetOutput(&b)
+	flags.PrintDefaults()
+	return b.String()
+}
+
+func readConfigFile(name string, cfg *Config) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", name, err)
+	}
+	return nil
+}
+
+func applyEnv(cfg *Config, getenv func(string) string) error {
+	ints := []struct {
+		name  string
+		value *int
+	}{
+		{"QUEUEIC_PORT", &cfg.Port},
+		{"QUEUEIC_WORKERS", &cfg.Workers},
+		{"QUEUEIC_BACKLOG", &cfg.Backlog},
+	}
+	for _, v := range ints {
+		if value := getenv(v.name); value != "" {
+			i, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %v", v.name, err)
+			}
+			*v.value = i
+		}
+	}
+	// QUEUEIC_LOG_LEVEL wins over the older LOG_LEVEL
+	vars := []struct {
+		name  string
+		value *string
+	}{
+		{"QUEUEIC_BIND_ADDRESS", &cfg.BindAddress},
+		{"QUEUEIC_HTTP_ADDRESS", &cfg.HTTPAddress},
+		{"QUEUEIC_DATA_DIR", &cfg.DataDir},
+		{"LOG_LEVEL", &cfg.LogLevel},
+		{"QUEUEIC_LOG_LEVEL", &cfg.LogLevel},
+		{"QUEUEIC_KEY_STRING", &cfg.Key},
+		{"QUEUEIC_OTLP_ENDPOINT", &cfg.OTLPEndpoint},
+	}
+	for _, v := range vars {
+		if value := getenv(v.name); value != "" {
+			*v.value = value
+		}
+	}
+	if rules := getenv("QUEUEIC_AUTO_CREATE"); rules != "" {
+		parsed, err := parseAutoCreateRules(rules)
+		if err != nil {
+			return fmt.Errorf("invalid QUEUEIC_AUTO_CREATE: %v", err)
+		}
+		cfg.AutoCreate = make([]AutoCreateConfig, len(parsed))
+		for i, rule := range parsed {
+			cfg.AutoCreate[i] = AutoCreateConfig{Pattern: rule.Pattern, QueueConfig: queueConfig(rule.Options)}
+		}
+	}
+	return nil
+}
+
+func (c Config) validate() error {
+	if c.Port <= 0 || c.Port > 0xffff {
+		return fmt.Errorf("port %d must be between 1 and 65535", c.Port)
+	}
+	if c.BindAddress != "" && net.ParseIP(c.BindAddress) == nil {
+		return fmt.Errorf("bind address %q is not an ip", c.BindAddress)
+	}
+	if _, _, err := net.SplitHostPort(c.HTTPAddress); err != nil {
+		return fmt.Errorf("invalid http address: %v", err)
+	}
+	if c.DataDir == "" {
+		return fmt.Errorf("data dir must not be empty")
+	}
+	if _, err := logLevel(c.LogLevel); err != nil {
+		return err
+	}
+	if c.ShutdownTimeout <= 0 {
+		return fmt.Errorf("shutdown timeout must be positive")
+	}
+	if c.Workers <= 0 || c.Backlog <= 0 {
+		return fmt.Errorf("workers %d and backlog %d must be positive", c.Workers, c.Backlog)
+	}
+	if _, err := c.QueueDefaults.options(); err != nil {
+		return fmt.Errorf("invalid queue defaults: %v", err)
+	}
+	for _, rule := range c.AutoCreate {
+		if _, err := path.Match(rule.Pattern, ""); err != nil || rule.Pattern == "" {
+			return fmt.Errorf("invalid auto create pattern %q", rule.Pattern)
+		}
+		if _, err := rule.options(); err != nil {
+			return fmt.Errorf("auto create rule %s: %v", rule.Pattern, err)
+		}
+	}
+	defined := make(map[proto.QueueName]bool, len(c.Queues))
+	for _, def := range c.Queues {
+		name, err := proto.NewQueueName(def.Name)
+		if err != nil {
+			return fmt.Errorf("invalid queue name %q: %v", def.Name, err)
+		}
+		if defined[name] {
+			return fmt.Errorf("queue %s is defined twice", def.Name)
+		}
+		defined[name] = true
+		options, err := def.options()
+		if err == nil {
+			err = options.Validate(name)
+		}
+		if err != nil {
+			return fmt.Errorf("queue %s: %v", def.Name, err)
+		}
+	}
+	rules := make([]server.AutoCreateRule, len(c.AutoCreate))
+	for i, rule := range c.AutoCreate {
+		options, _ := rule.options()
+		rules[i] = server.AutoCreateRule{Pattern: rule.Pattern, Options: options}
+	}
+	return checkDeadLetters(rules, defined)
+}
+
+func (q QueueConfig) options() (queue.Options, error) {
+	options := queue.Options{MaxLength: q.MaxLength, TTL: time.Duration(q.TTL)}
+	if q.MaxLength < 0 {
+		return options, fmt.Errorf("max_length must not be negative")
+	}
+	if q.TTL < 0 {
+		return options, fmt.Errorf("ttl must not be negative")
+	}
+	if q.DeadLetter != "" {
+		name, err := proto.NewQueueName(q.DeadLetter)
+		if err != nil {
+			return options, fmt.Errorf("invalid dead_letter: %v", err)
+		}
+		options.DeadLetter = name
+	}
+	return options, nil
+}
+
+func queueConfig(options queue.Options) QueueConfig {
+	return QueueConfig{MaxLength: options.MaxLength, TTL: Duration(options.TTL), DeadLetter: options.DeadLetter.String()}
+}
+
+func logLevel(level string) (mlog.Level, error) {
+	switch strings.ToLower(level) {
+	case "error":
+		return mlog.Lerror, nil
+	case "warn":
+		return mlog.Lwarn, nil
+	case "info":
+		return mlog.Linfo, nil
+	case "debug":
+		return mlog.Ldebug, nil
+	case "trace":
+		return mlog.Ltrace, nil
+	default:
+		return 0, fmt.Errorf("unknown log level %q, use error, warn, info, debug or trace", level)
+	}
+}
+
+// apply configures the server, the config must be valid
+func (c Config) apply(s *server.QueuicServer) {
+	s.Port = c.Port
+	s.BindAddress = c.BindAddress
+	s.DataDir = c.DataDir
+	s.Workers = c.Workers
+	s.Backlog = c.Backlog
+	settings := c.settings()
+	s.Queues = settings.Queues
+	s.DefaultOptions = settings.DefaultOptions
+	s.AutoCreate = settings.AutoCreate
+}
+
+// settings returns the settings which can be reloaded, the config must be valid
+func (c Config) settings() server.Settings {
+	settings := server.Settings{Key: c.Key}
+	settings.DefaultOptions, _ = c.QueueDefaults.options()
+	settings.AutoCreate = make([]server.AutoCreateRule, len(c.AutoCreate))
+	for i, rule := range c.AutoCreate {
+		options, _ := rule.options()
+		settings.AutoCreate[i] = server.AutoCreateRule{Pattern: rule.Pattern, Options: options}
+	}
+	settings.Queues = make([]server.QueueDefinition, len(c.Queues))
+	for i, def := range c.Queues {
+		options, _ := def.options()
+		settings.Queues[i] = server.QueueDefinition{Name: proto.QueueName(def.Name), Options: options}
+	}
+	return settings
+}
+
+// restartChanges returns the keys which differ from the running
+// config and are applied only when the broker is restarted
+func (c Config) restartChanges(running Config) []string {
+	changed := make([]string, 0)
+	for _, setting := range []struct {
+		key     string
+		changed bool
+	}{
+		{"port", c.Port != running.Port},
+		{"bind_address", c.BindAddress != running.BindAddress},
+		{"http_address", c.HTTPAddress != running.HTTPAddress},
+		{"data_dir", c.DataDir != running.DataDir},
+		{"otlp_endpoint", c.OTLPEndpoint != running.OTLPEndpoint},
+		{"shutdown_timeout", c.ShutdownTimeout != running.ShutdownTimeout},
+		{"workers", c.Workers != running.Workers},
+		{"backlog", c.Backlog != running.Backlog},
+	} {
+		if setting.changed {
+			changed = append(changed, setting.key)
+		}
+	}
+	return changed
+}
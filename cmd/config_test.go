@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "queueic.json")
+	os.WriteFile(file, []byte(`{
+		"port": 9000,
+		"http_address": "127.0.0.1:9080",
+		"data_dir": "/var/lib/queueic",
+		"log_level": "debug",
+		"shutdown_timeout": "5s",
+		"queue_defaults": {"max_length": 100, "ttl": "1h"},
+		"auto_create": [{"pattern": "tenant-dlq"}, {"pattern": "tenant-*", "dead_letter": "tenant-dlq"}],
+		"queues": [{"name": "orders", "max_length": 1000, "dead_letter": "orders-dlq"}, {"name": "orders-dlq"}]
+	}`), 0644)
+	env := map[string]string{"QUEUEIC_CONFIG": file, "QUEUEIC_PORT": "9001", "QUEUEIC_LOG_LEVEL": "warn"}
+	cfg, err := loadConfig([]string{"-log-level", "trace", "-workers", "8"}, func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	if cfg.Port != 9001 || cfg.HTTPAddress != "127.0.0.1:9080" || cfg.DataDir != "/var/lib/queueic" || cfg.LogLevel != "trace" || cfg.Workers != 8 {
+		t.Errorf("unexpected precedence in config %+v", cfg)
+	}
+	if cfg.ShutdownTimeout != Duration(5*time.Second) || cfg.QueueDefaults.TTL != Duration(time.Hour) || cfg.QueueDefaults.MaxLength != 100 {
+		t.Errorf("unexpected durations in config %+v", cfg)
+	}
+	if len(cfg.AutoCreate) != 2 || cfg.AutoCreate[1].DeadLetter != "tenant-dlq" {
+		t.Errorf("unexpected auto create rules %+v", cfg.AutoCreate)
+	}
+	if len(cfg.Queues) != 2 || cfg.Queues[0].Name != "orders" || cfg.Queues[0].MaxLength != 1000 {
+		t.Errorf("unexpected queues %+v", cfg.Queues)
+	}
+
+	cfg, err = loadConfig(nil, func(string) string { return "" })
+	if err != nil || !reflect.DeepEqual(cfg, defaultConfig()) {
+		t.Errorf("expected default config, got %+v: %v", cfg, err)
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	duplicate := filepath.Join(t.TempDir(), "duplicate.json")
+	os.WriteFile(duplicate, []byte(`{"queues": [{"name": "orders"}, {"name": "orders", "ttl": "1h"}]}`), 0644)
+	deadLetter := filepath.Join(t.TempDir(), "dead-letter.json")
+	os.WriteFile(deadLetter, []byte(`{"queues": [{"name": "orders", "ttl": "1h", "dead_letter": "orders"}]}`), 0644)
+	for _, env := range []map[string]string{
+		{"QUEUEIC_PORT": "70000"},
+		{"QUEUEIC_WORKERS": "0"},
+		{"QUEUEIC_BACKLOG": "many"},
+		{"QUEUEIC_BIND_ADDRESS": "localhost"},
+		{"QUEUEIC_HTTP_ADDRESS": "8080"},
+		{"QUEUEIC_LOG_LEVEL": "verbose"},
+		{"QUEUEIC_AUTO_CREATE": "tenant-*:max_length=-1"},
+		{"QUEUEIC_AUTO_CREATE": "[:ttl=1h"},
+		{"QUEUEIC_CONFIG": "missing.json"},
+		{"QUEUEIC_CONFIG": duplicate},
+		{"QUEUEIC_CONFIG": deadLetter},
+		// the dead letter queue would be created by the rule itself
+		{"QUEUEIC_AUTO_CREATE": "tenant-*:ttl=1h,dead_letter=tenant-dlq;tenant-dlq"},
+	} {
+		if _, err := loadConfig(nil, func(name string) string { return env[name] }); err == nil {
+			t.Errorf("expected error for %v", env)
+		}
+	}
+	if _, err := loadConfig([]string{"-unknown"}, func(string) string { return "" }); err == nil {
+		t.Errorf("expected error for unknown flag")
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// dashboard is a web ui which uses the http interface of the manager
+//
+//go:embed dashboard
+var dashboard embed.FS
+
+func dashboardHandler() http.Handler {
+	files, err := fs.Sub(dashboard, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServer(http.FS(files))
+}
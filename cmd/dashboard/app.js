@@ -0,0 +1,237 @@
+// The dashboard polls /queues and keeps the latest samples of every
+// queue in the browser to show the size over time.
+"use strict";
+
+const POLL_INTERVAL = 2000;
+const MAX_SAMPLES = 60;
+const PAGE_SIZE = 50;
+
+const history = new Map();
+let selected = null;
+let offset = 0;
+
+async function api(method, path, body) {
+  const options = { method: method, headers: {} };
+  if (body !== undefined) {
+    options.headers["Content-Type"] = "application/json";
+    options.body = JSON.stringify(body);
+  }
+  const resp = await fetch(path, options);
+  if (!resp.ok) {
+    let message = resp.statusText;
+    try {
+      message = (await resp.json()).error;
+    } catch (e) {}
+    throw new Error(message);
+  }
+  if (resp.status === 204) {
+    return null;
+  }
+  return resp.json();
+}
+
+function queuePath(name) {
+  return "/queues/" + encodeURIComponent(name);
+}
+
+function setStatus(text) {
+  document.getElementById("status").textContent = text;
+}
+
+function cell(row, text, className) {
+  const td = row.insertCell();
+  td.textContent = text;
+  if (className) {
+    td.className = className;
+  }
+  return td;
+}
+
+function record(stats) {
+  const now = Date.now();
+  const names = new Set();
+  for (const s of stats) {
+    names.add(s.queue_name);
+    if (!history.has(s.queue_name)) {
+      history.set(s.queue_name, []);
+    }
+    const samples = history.get(s.queue_name);
+    samples.push({ time: now, size: s.size });
+    if (samples.length > MAX_SAMPLES) {
+      samples.shift();
+    }
+  }
+  for (const name of history.keys()) {
+    if (!names.has(name)) {
+      history.delete(name);
+    }
+  }
+}
+
+function rate(perSecond) {
+  return perSecond.toFixed(1) + "/s";
+}
+
+// seconds formats a duration in seconds, e.g. 850ms or 2m 5s
+function seconds(s) {
+  if (s < 1) {
+    return Math.round(s * 1000) + "ms";
+  }
+  if (s < 60) {
+    return s.toFixed(1) + "s";
+  }
+  return Math.floor(s / 60) + "m " + Math.round(s % 60) + "s";
+}
+
+function sparkline(samples) {
+  const svg = document.createElementNS("http://www.w3.org/2000/svg", "svg");
+  svg.setAttribute("class", "spark");
+  svg.setAttribute("viewBox", "0 0 " + MAX_SAMPLES + " 24");
+  svg.setAttribute("preserveAspectRatio", "none");
+  const max = Math.max(1, ...samples.map((s) => s.size));
+  const points = samples.map((s, i) => i + "," + (23 - (s.size / max) * 22).toFixed(1));
+  const line = document.createElementNS("http://www.w3.org/2000/svg", "polyline");
+  line.setAttribute("points", points.join(" "));
+  svg.appendChild(line);
+  return svg;
+}
+
+function renderQueues(stats) {
+  const body = document.querySelector("#queues tbody");
+  body.replaceChildren();
+  stats.sort((a, b) => a.queue_name.localeCompare(b.queue_name));
+  for (const s of stats) {
+    const samples = history.get(s.queue_name) || [];
+    const row = body.insertRow();
+    if (s.queue_name === selected) {
+      row.className = "selected";
+    }
+    row.onclick = () => select(s.queue_name);
+    cell(row, s.queue_name);
+    cell(row, s.size, "number");
+    cell(row, s.enequeued, "number");
+    cell(row, s.dequeued, "number");
+    cell(row, rate(s.enqueue_rate_1m), "number");
+    cell(row, rate(s.dequeue_rate_1m), "number");
+    cell(row, seconds(s.oldest_age_seconds), "number");
+    cell(row, seconds(s.avg_time_in_queue_seconds), "number");
+    cell(row, seconds(s.avg_processing_seconds), "number");
+    row.insertCell().appendChild(sparkline(samples));
+  }
+}
+
+async function poll() {
+  try {
+    const stats = await api("GET", "/queues");
+    record(stats);
+    renderQueues(stats);
+    setStatus("updated " + new Date().toLocaleTimeString());
+    if (selected && !history.has(selected)) {
+      deselect();
+    }
+  } catch (e) {
+    setStatus("failed to load queues: " + e.message);
+  }
+}
+
+async function select(name) {
+  selected = name;
+  offset = 0;
+  document.getElementById("detail").hidden = false;
+  document.getElementById("detail-name").textContent = name;
+  document.getElementById("result").textContent = "";
+  await Promise.all([loadOptions(), loadMessages()]);
+  poll();
+}
+
+function deselect() {
+  selected = null;
+  document.getElementById("detail").hidden = true;
+}
+
+async function loadOptions() {
+  const text = document.getElementById("detail-options");
+  try {
+    const info = await api("GET", queuePath(selected));
+    const o = info.options;
+    text.textContent = "max length " + (o.maxLength || "unlimited") +
+      ", ttl " + (o.ttl || "none") + ", dead letter queue " + (o.deadLetter || "none");
+  } catch (e) {
+    text.textContent = e.message;
+  }
+}
+
+async function loadMessages() {
+  const body = document.querySelector("#messages tbody");
+  const page = await api("GET", queuePath(selected) + "/messages?offset=" + offset + "&limit=" + PAGE_SIZE);
+  body.replaceChildren();
+  for (const m of page.items) {
+    const row = body.insertRow();
+    cell(row, m.id);
+    cell(row, m.size, "number");
+    cell(row, new Date(m.enqueued_at).toLocaleString());
+    cell(row, m.in_flight ? "in flight" : "waiting");
+    cell(row, m.headers ? JSON.stringify(m.headers) : "");
+  }
+  const last = Math.min(page.total, offset + page.items.length);
+  document.getElementById("page").textContent = page.total === 0 ?
+    "no messages" : (offset + 1) + " - " + last + " of " + page.total;
+  document.getElementById("prev").disabled = offset === 0;
+  document.getElementById("next").disabled = last >= page.total;
+}
+
+async function action(confirmText, run) {
+  if (confirmText && !confirm(confirmText)) {
+    return;
+  }
+  try {
+    document.getElementById("result").textContent = await run();
+  } catch (e) {
+    alert(e.message);
+  }
+  if (selected) {
+    await loadMessages().catch(() => {});
+  }
+  await poll();
+}
+
+document.getElementById("purge").onclick = () => action(
+  "Remove all waiting messages of " + selected + "?",
+  async () => {
+    const r = await api("POST", queuePath(selected) + "/purge", {});
+    return "purged " + r.purged + " messages";
+  });
+
+document.getElementById("redrive").onclick = () => {
+  // a dead letter queue is usually named like its source with a suffix
+  const guess = selected.replace(/[-_.]?(dlq|dead-letter)$/, "");
+  const destination = prompt("Move all waiting messages of " + selected + " to", guess === selected ? "" : guess);
+  if (!destination) {
+    return;
+  }
+  action(null, async () => {
+    const r = await api("POST", queuePath(selected) + "/move", { destination: destination });
+    return "moved " + r.moved + " messages to " + destination;
+  });
+};
+
+document.getElementById("delete").onclick = () => action(
+  "Delete the queue " + selected + " with all its messages?",
+  async () => {
+    await api("DELETE", queuePath(selected));
+    deselect();
+    return "";
+  });
+
+document.getElementById("prev").onclick = () => {
+  offset = Math.max(0, offset - PAGE_SIZE);
+  loadMessages();
+};
+
+document.getElementById("next").onclick = () => {
+  offset += PAGE_SIZE;
+  loadMessages();
+};
+
+poll();
+setInterval(poll, POLL_INTERVAL);
@@ -1,90 +1,635 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/dinifarb/mlog"
 	"github.com/dinifarb/queuic/pkg/proto"
+	"github.com/dinifarb/queuic/pkg/queue"
+	"github.com/dinifarb/queuic/pkg/server"
+	"github.com/google/uuid"
+)
+
+const (
+	EVENTS_HEARTBEAT     = 15 * time.Second
+	METRICS_CONTENT_TYPE = "text/plain; version=0.0.4"
 )
 
 type Manager struct {
 	http.ServeMux
+	routes []route
+	server *http.Server
+	// done is closed on shutdown to end the event streams
+	done chan struct{}
+	// Reload reloads the config, nil if the config can't be reloaded
+	Reload func() error
+}
+
+// route matches paths like /queues/{name}, the segments
+// in braces are passed as params to the handler. The summary,
+// request and responses describe the route in the openapi spec,
+// the request of a GET route describes its query parameters.
+type route struct {
+	method    string
+	pattern   string
+	handler   func(w http.ResponseWriter, r *http.Request, params map[string]string)
+	summary   string
+	request   interface{}
+	responses responses
 }
 
+// responses maps a status to its body, nil for no body
+type responses map[int]interface{}
+
 func NewManager() *Manager {
-	return &Manager{}
+	m := &Manager{done: make(chan struct{})}
+	m.server = &http.Server{Addr: DEFAULT_HTTP_ADDRESS, Handler: m}
+	m.routes = []route{
+		{http.MethodGet, "/queues", m.listQueuesHandler,
+			"list the stats of all queues", nil, responses{http.StatusOK: []server.QueueStats{}}},
+		{http.MethodGet, "/queues/{name}", m.getQueueHandler,
+			"get the stats and options of a queue", nil, responses{http.StatusOK: QueueResponse{}}},
+		{http.MethodPut, "/queues/{name}", m.putQueueHandler,
+			"create a queue or update its options", QueueOptions{}, responses{http.StatusOK: QueueResponse{}, http.StatusCreated: QueueResponse{}}},
+		{http.MethodDelete, "/queues/{name}", m.deleteQueueHandler,
+			"delete a queue", nil, responses{http.StatusNoContent: nil}},
+		{http.MethodGet, "/queues/{name}/messages", m.browseHandler,
+			"list messages without peeking them", BrowseRequest{}, responses{http.StatusOK: server.BrowsePage{}}},
+		{http.MethodPost, "/queues/{name}/messages", m.postMessageHandler,
+			"enqueue a message", MessageRequest{}, responses{http.StatusCreated: MessageResponse{}}},
+		{http.MethodPost, "/queues/{name}/peek", m.peekHandler,
+			"peek messages, they stay in flight until they are accepted or released", PeekRequest{}, responses{http.StatusOK: PeekResponse{}}},
+		{http.MethodPost, "/queues/{name}/messages/{id}/accept", m.acceptHandler,
+			"accept a peeked message", nil, responses{http.StatusNoContent: nil}},
+		{http.MethodPost, "/queues/{name}/messages/{id}/release", m.releaseHandler,
+			"release a peeked message", nil, responses{http.StatusNoContent: nil}},
+		{http.MethodPost, "/queues/{name}/purge", m.purgeHandler,
+			"remove the waiting messages, with inFlight also the in flight ones", PurgeRequest{}, responses{http.StatusOK: PurgeResponse{}}},
+		{http.MethodPost, "/queues/{name}/move", m.moveHandler,
+			"move the waiting messages which match the filter to another queue", server.MoveRequest{}, responses{http.StatusOK: MoveResponse{}}},
+		{http.MethodGet, "/events", m.eventsHandler,
+			"stream the events of all queues or of the given queues", EventsRequest{}, responses{http.StatusOK: eventStream{server.Event{}}}},
+		{http.MethodGet, "/metrics", m.metricsHandler,
+			"get the metrics in the Prometheus text format", nil, responses{http.StatusOK: textContent{METRICS_CONTENT_TYPE}}},
+		{http.MethodPost, "/reload", m.reloadHandler,
+			"reload the config, the queues keep their items and in flight messages", nil, responses{http.StatusNoContent: nil}},
+		{http.MethodGet, "/openapi.json", m.openapiHandler,
+			"get this openapi spec", nil, responses{http.StatusOK: map[string]interface{}{}}},
+		// the first version of the interface
+		{http.MethodGet, "/stats", m.statsHandler,
+			"list the stats of all queues", nil, responses{http.StatusOK: []server.QueueStats{}}},
+		{http.MethodPost, "/createQueue", m.createQueueHandler,
+			"create a queue", CreateQueueRequest{}, responses{http.StatusCreated: ""}},
+		{http.MethodPost, "/enqueue", m.enqueueHandler,
+			"enqueue a message", EnqueueRequest{}, responses{http.StatusCreated: ""}},
+	}
+	m.HandleFunc("/", m.serveRoutes)
+	m.Handle("/dashboard/", http.StripPrefix("/dashboard/", dashboardHandler()))
+	return m
 }
 
 func (m *Manager) Start() error {
-	m.HandleFunc("/stats", m.statsHandler)
-	m.HandleFunc("/createQueue", m.createQueueHandler)
-	//m.HandleFunc("/deleteQueue", m.deleteQueueHandler)
-	m.HandleFunc("/enqueue", m.enqueueHandler)
-	mlog.Info("starting http interface on port 8080")
-	return http.ListenAndServe(":8080", m)
+	mlog.Info("starting http interface on %s", m.server.Addr)
+	if err := m.server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
 }
 
-func (m *Manager) statsHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(srv.GetStats())
+// Shutdown stops accepting connections and waits for the running
+// requests, the event streams are ended
+func (m *Manager) Shutdown(ctx context.Context) error {
+	close(m.done)
+	return m.server.Shutdown(ctx)
 }
 
-type CreateQueueRequest struct {
-	QueueName string `json:"queueName"`
+func (m *Manager) serveRoutes(w http.ResponseWriter, r *http.Request) {
+	allowed := make([]string, 0)
+	for _, route := range m.routes {
+		params, ok := matchPath(route.pattern, r.URL.Path)
+		if !ok {
+			continue
+		}
+		if route.method == r.Method {
+			route.handler(w, r, params)
+			return
+		}
+		allowed = append(allowed, route.method)
+	}
+	if len(allowed) > 0 {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeError(w, http.StatusNotFound, "not found")
+}
+
+func matchPath(pattern string, path string) (map[string]string, bool) {
+	patternParts := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathParts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(patternParts) != len(pathParts) {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for i, part := range patternParts {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			params[strings.Trim(part, "{}")] = pathParts[i]
+			continue
+		}
+		if part != pathParts[i] {
+			return nil, false
+		}
+	}
+	return params, true
 }
 
-func (m *Manager) createQueueHandler(w http.ResponseWriter, r *http.Request) {
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
 	w.Header().Set("Content-Type", "application/json")
-	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		json.NewEncoder(w).Encode("method not allowed")
+	w.WriteHeader(status)
+	if v != nil {
+		json.NewEncoder(w).Encode(v)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, ErrorResponse{Error: message})
+}
+
+// writeServerError maps the errors of the server to a status code
+func writeServerError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, server.ErrBadRequest):
+		status = http.StatusBadRequest
+	case errors.Is(err, server.ErrQueueNotFound), errors.Is(err, server.ErrItemNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, server.ErrQueueExists), errors.Is(err, queue.ErrFull):
+		status = http.StatusConflict
+	case errors.Is(err, queue.ErrClosed):
+		status = http.StatusServiceUnavailable
+	}
+	writeError(w, status, err.Error())
+}
+
+func queueName(w http.ResponseWriter, params map[string]string) (proto.QueueName, bool) {
+	name, err := proto.NewQueueName(params["name"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return "", false
+	}
+	return name, true
+}
+
+// decodeBody decodes the json body, an empty body leaves v unchanged
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.ContentLength == 0 {
+		return true
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid json body: %v", err))
+		return false
+	}
+	return true
+}
+
+type QueueOptions struct {
+	MaxLength  int    `json:"maxLength,omitempty"`
+	TTL        string `json:"ttl,omitempty"`
+	DeadLetter string `json:"deadLetter,omitempty"`
+}
+
+func (o QueueOptions) parse(name proto.QueueName) (queue.Options, error) {
+	options := queue.Options{MaxLength: o.MaxLength}
+	if o.MaxLength < 0 {
+		return options, fmt.Errorf("maxLength must not be negative")
+	}
+	if o.TTL != "" {
+		ttl, err := time.ParseDuration(o.TTL)
+		if err != nil {
+			return options, fmt.Errorf("invalid ttl: %v", err)
+		}
+		options.TTL = ttl
+	}
+	if o.DeadLetter != "" {
+		deadLetter, err := proto.NewQueueName(o.DeadLetter)
+		if err != nil {
+			return options, fmt.Errorf("invalid deadLetter: %v", err)
+		}
+		options.DeadLetter = deadLetter
+	}
+	return options, options.Validate(name)
+}
+
+func queueOptions(options queue.Options) QueueOptions {
+	o := QueueOptions{
+		MaxLength:  options.MaxLength,
+		DeadLetter: options.DeadLetter.String(),
+	}
+	if options.TTL > 0 {
+		o.TTL = options.TTL.String()
+	}
+	return o
+}
+
+type QueueResponse struct {
+	server.QueueStats
+	Options QueueOptions `json:"options"`
+}
+
+func (m *Manager) listQueuesHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	writeJSON(w, http.StatusOK, srv.GetStats())
+}
+
+func (m *Manager) getQueueHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	name, ok := queueName(w, params)
+	if !ok {
+		return
+	}
+	stats, err := srv.GetQueueStats(name)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	options, err := srv.QueueOptions(name)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, QueueResponse{QueueStats: stats, Options: queueOptions(options)})
+}
+
+// putQueueHandler creates the queue or updates its options
+func (m *Manager) putQueueHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	name, ok := queueName(w, params)
+	if !ok {
+		return
+	}
+	var body QueueOptions
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	options, err := body.parse(name)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	status := http.StatusOK
+	err = srv.UpdateQueueOptions(name, options)
+	if errors.Is(err, server.ErrQueueNotFound) {
+		status = http.StatusCreated
+		err = srv.CreateQueueWithOptions(name, options)
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	m.getQueueHandler(&statusWriter{ResponseWriter: w, status: status}, r, params)
+}
+
+// statusWriter replaces the status of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if status == http.StatusOK {
+		status = w.status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (m *Manager) deleteQueueHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	name, ok := queueName(w, params)
+	if !ok {
+		return
+	}
+	if err := srv.DeleteQueue(name); err != nil {
+		writeServerError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type MessageRequest struct {
+	Message string            `json:"message"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+type MessageResponse struct {
+	Id string `json:"id"`
+}
+
+func (m *Manager) postMessageHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	name, ok := queueName(w, params)
+	if !ok {
+		return
+	}
+	var body MessageRequest
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	id, err := srv.Enqueue(name, []byte(body.Message), body.Headers)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, MessageResponse{Id: id.String()})
+}
+
+type PeekRequest struct {
+	Max int `json:"max,omitempty"`
+}
+
+type Message struct {
+	Id      string            `json:"id"`
+	Message string            `json:"message"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Encoding is base64 if the message is not valid utf-8
+	Encoding   string    `json:"encoding,omitempty"`
+	EnqueuedAt time.Time `json:"enqueuedAt"`
+}
+
+type PeekResponse struct {
+	Messages []Message `json:"messages"`
+}
+
+func newMessage(item proto.QueuicItem) Message {
+	m := Message{
+		Id:         item.Id.String(),
+		Message:    string(item.Item),
+		Headers:    item.Headers,
+		EnqueuedAt: item.Timestamp,
+	}
+	if !utf8.Valid(item.Item) {
+		m.Message = base64.StdEncoding.EncodeToString(item.Item)
+		m.Encoding = "base64"
+	}
+	return m
+}
+
+// peekHandler returns up to max messages, they stay in flight until
+// they are accepted or released. An empty queue returns no messages.
+func (m *Manager) peekHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	name, ok := queueName(w, params)
+	if !ok {
+		return
+	}
+	body := PeekRequest{Max: 1}
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	if body.Max <= 0 || body.Max > proto.MAX_BATCH_SIZE {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("max must be between 1 and %d", proto.MAX_BATCH_SIZE))
+		return
+	}
+	items, err := srv.Peek(name, body.Max)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	resp := PeekResponse{Messages: make([]Message, len(items))}
+	for i, item := range items {
+		resp.Messages[i] = newMessage(item)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+type BrowseRequest struct {
+	Offset int `json:"offset,omitempty"`
+	Limit  int `json:"limit,omitempty"`
+}
+
+// browseHandler lists the messages with their size, headers and
+// in flight status, but without their data and state change
+func (m *Manager) browseHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	name, ok := queueName(w, params)
+	if !ok {
+		return
+	}
+	req := BrowseRequest{Limit: 100}
+	query := r.URL.Query()
+	for key, v := range map[string]*int{"offset": &req.Offset, "limit": &req.Limit} {
+		if query.Get(key) == "" {
+			continue
+		}
+		n, err := strconv.Atoi(query.Get(key))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s: %v", key, err))
+			return
+		}
+		*v = n
+	}
+	page, err := srv.Browse(name, req.Offset, req.Limit)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func (m *Manager) acceptHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	m.settle(w, params, srv.Accept)
+}
+
+func (m *Manager) releaseHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	m.settle(w, params, srv.Release)
+}
+
+func (m *Manager) settle(w http.ResponseWriter, params map[string]string, settle func(proto.QueueName, uuid.UUID) error) {
+	name, ok := queueName(w, params)
+	if !ok {
+		return
+	}
+	id, err := uuid.Parse(params["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid message id: %v", err))
+		return
+	}
+	if err := settle(name, id); err != nil {
+		writeServerError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type PurgeRequest struct {
+	InFlight bool `json:"inFlight,omitempty"`
+}
+
+type PurgeResponse struct {
+	Purged int `json:"purged"`
+}
+
+func (m *Manager) purgeHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	name, ok := queueName(w, params)
+	if !ok {
+		return
+	}
+	var body PurgeRequest
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	n, err := srv.PurgeQueue(name, body.InFlight)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, PurgeResponse{Purged: n})
+}
+
+type MoveResponse struct {
+	Moved int `json:"moved"`
+}
+
+func (m *Manager) moveHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	name, ok := queueName(w, params)
+	if !ok {
+		return
+	}
+	var body server.MoveRequest
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	n, err := srv.MoveItems(name, body.Destination, body.MoveFilter)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, MoveResponse{Moved: n})
+}
+
+type EventsRequest struct {
+	Queue []string `json:"queue,omitempty"`
+}
+
+// eventsHandler streams the events as server sent events until the
+// client disconnects, a comment is sent every EVENTS_HEARTBEAT to keep
+// the connection open
+func (m *Manager) eventsHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+	queues := make([]proto.QueueName, 0)
+	for _, q := range r.URL.Query()["queue"] {
+		name, err := proto.NewQueueName(q)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		queues = append(queues, name)
+	}
+	sub := srv.Subscribe(queues...)
+	defer srv.Unsubscribe(sub)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	heartbeat := time.NewTicker(EVENTS_HEARTBEAT)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-m.done:
+			return
+		case e, ok := <-sub.Events:
+			if !ok {
+				return
+			}
+			b, err := json.Marshal(e)
+			if err != nil {
+				mlog.Error("failed to marshal event: %v", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, b)
+		case <-heartbeat.C:
+			fmt.Fprintf(w, ": dropped %d\n\n", sub.Dropped())
+		}
+		flusher.Flush()
+	}
+}
+
+func (m *Manager) metricsHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	w.Header().Set("Content-Type", METRICS_CONTENT_TYPE)
+	if err := srv.WriteMetrics(w); err != nil {
+		mlog.Error("error writing metrics: %v", err)
+	}
+}
+
+func (m *Manager) reloadHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if m.Reload == nil {
+		writeError(w, http.StatusNotImplemented, "reload is not supported")
+		return
+	}
+	if err := m.Reload(); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to reload the config: %v", err))
 		return
 	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (m *Manager) statsHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	writeJSON(w, http.StatusOK, srv.GetStats())
+}
+
+type CreateQueueRequest struct {
+	QueueName string `json:"queueName"`
+}
+
+func (m *Manager) createQueueHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
 	var body CreateQueueRequest
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode("bad request")
+		writeError(w, http.StatusBadRequest, "bad request")
+		return
+	}
+	name, err := proto.NewQueueName(body.QueueName)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	name := proto.QueueName{}
-	name.ParseFromString(body.QueueName)
 	if err := srv.CreateQueue(name); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode("internal server error")
+		writeServerError(w, err)
 		return
 	}
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode("queue created")
+	writeJSON(w, http.StatusCreated, "queue created")
 }
 
 type EnqueueRequest struct {
-	QueueName string `json:"queueName"`
-	Message   string `json:"message"`
+	QueueName string            `json:"queueName"`
+	Message   string            `json:"message"`
+	Headers   map[string]string `json:"headers,omitempty"`
 }
 
-func (m *Manager) enqueueHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		json.NewEncoder(w).Encode("method not allowed")
-		return
-	}
+func (m *Manager) enqueueHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
 	var body EnqueueRequest
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode("bad request")
+		writeError(w, http.StatusBadRequest, "bad request")
+		return
+	}
+	name, err := proto.NewQueueName(body.QueueName)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	name := proto.QueueName{}
-	name.ParseFromString(body.QueueName)
-	if err := srv.Enqueue(name, []byte(body.Message)); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(fmt.Sprintf(`{"error": "internal server error: %s"}`, err.Error()))
+	if _, err := srv.Enqueue(name, []byte(body.Message), body.Headers); err != nil {
+		writeServerError(w, err)
 		return
 	}
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode("message enqueued")
+	writeJSON(w, http.StatusCreated, "message enqueued")
 }
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dinifarb/queuic/pkg/server"
+)
+
+func request(t *testing.T, m *Manager, method string, path string, body interface{}, v interface{}) int {
+	var b []byte
+	if body != nil {
+		b, _ = json.Marshal(body)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(b))
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, req)
+	if v != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Errorf("%s %s: invalid response %q: %v", method, path, rec.Body.String(), err)
+		}
+	}
+	return rec.Code
+}
+
+func TestManagerRestApi(t *testing.T) {
+	srv = server.NewQueuicServer("test")
+	m := NewManager()
+	defer srv.DeleteQueue("rest-test")
+
+	if code := request(t, m, http.MethodGet, "/queues/rest-test", nil, nil); code != http.StatusNotFound {
+		t.Errorf("get of missing queue returned %d", code)
+	}
+	var info QueueResponse
+	code := request(t, m, http.MethodPut, "/queues/rest-test", QueueOptions{MaxLength: 10, TTL: "1h"}, &info)
+	if code != http.StatusCreated || info.Options.MaxLength != 10 || info.Options.TTL != "1h0m0s" {
+		t.Errorf("create returned %d %+v", code, info)
+	}
+	var updated QueueResponse
+	code = request(t, m, http.MethodPut, "/queues/rest-test", QueueOptions{MaxLength: 5}, &updated)
+	if code != http.StatusOK || updated.Options.MaxLength != 5 || updated.Options.TTL != "" {
+		t.Errorf("update returned %d %+v", code, updated)
+	}
+	if code := request(t, m, http.MethodPut, "/queues/rest-test", QueueOptions{TTL: "1s", DeadLetter: "rest-test"}, nil); code != http.StatusBadRequest {
+		t.Errorf("put of the queue as its own dead letter queue returned %d", code)
+	}
+	if code := request(t, m, http.MethodPut, "/queues/rest-test", QueueOptions{TTL: "soon"}, nil); code != http.StatusBadRequest {
+		t.Errorf("invalid ttl returned %d", code)
+	}
+
+	var created MessageResponse
+	code = request(t, m, http.MethodPost, "/queues/rest-test/messages", MessageRequest{Message: "hello", Headers: map[string]string{"k": "v"}}, &created)
+	if code != http.StatusCreated || created.Id == "" {
+		t.Errorf("enqueue returned %d %+v", code, created)
+	}
+	var page server.BrowsePage
+	code = request(t, m, http.MethodGet, "/queues/rest-test/messages?offset=0&limit=1", nil, &page)
+	if code != http.StatusOK || page.Total != 1 || len(page.Items) != 1 || page.Items[0].Size != 5 || page.Items[0].InFlight {
+		t.Errorf("browse returned %d %+v", code, page)
+	}
+	if code := request(t, m, http.MethodGet, "/queues/rest-test/messages?limit=x", nil, nil); code != http.StatusBadRequest {
+		t.Errorf("browse with invalid limit returned %d", code)
+	}
+	var peeked PeekResponse
+	code = request(t, m, http.MethodPost, "/queues/rest-test/peek", PeekRequest{Max: 10}, &peeked)
+	if code != http.StatusOK || len(peeked.Messages) != 1 || peeked.Messages[0].Id != created.Id || peeked.Messages[0].Headers["k"] != "v" {
+		t.Errorf("peek returned %d %+v", code, peeked)
+	}
+	release := "/queues/rest-test/messages/" + created.Id + "/release"
+	if code := request(t, m, http.MethodPost, release, nil, nil); code != http.StatusNoContent {
+		t.Errorf("release returned %d", code)
+	}
+	if code := request(t, m, http.MethodPost, release, nil, nil); code != http.StatusNotFound {
+		t.Errorf("release of an item not in flight returned %d", code)
+	}
+	request(t, m, http.MethodPost, "/queues/rest-test/peek", nil, &peeked)
+	accept := "/queues/rest-test/messages/" + created.Id + "/accept"
+	if code := request(t, m, http.MethodPost, accept, nil, nil); code != http.StatusNoContent {
+		t.Errorf("accept returned %d", code)
+	}
+	code = request(t, m, http.MethodPost, "/queues/rest-test/peek", nil, &peeked)
+	if code != http.StatusOK || len(peeked.Messages) != 0 {
+		t.Errorf("peek of empty queue returned %d %+v", code, peeked)
+	}
+
+	var errResp ErrorResponse
+	code = request(t, m, http.MethodPatch, "/queues/rest-test", nil, &errResp)
+	if code != http.StatusMethodNotAllowed || errResp.Error == "" {
+		t.Errorf("patch returned %d %+v", code, errResp)
+	}
+	if code := request(t, m, http.MethodDelete, "/queues/rest-test", nil, nil); code != http.StatusNoContent {
+		t.Errorf("delete returned %d", code)
+	}
+	if code := request(t, m, http.MethodDelete, "/queues/rest-test", nil, nil); code != http.StatusNotFound {
+		t.Errorf("delete of missing queue returned %d", code)
+	}
+}
+
+func TestManagerEvents(t *testing.T) {
+	srv = server.NewQueuicServer("test")
+	ts := httptest.NewServer(NewManager())
+	defer ts.Close()
+	srv.CreateQueue("events-other")
+	defer srv.DeleteQueue("events-other")
+
+	resp, err := http.Get(ts.URL + "/events?queue=events-test")
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("unexpected content type %s", resp.Header.Get("Content-Type"))
+	}
+	srv.Enqueue("events-other", []byte("filtered"), nil)
+	srv.CreateQueue("events-test")
+	id, _ := srv.Enqueue("events-test", []byte("hello"), nil)
+	srv.DeleteQueue("events-test")
+
+	events := make([]server.Event, 0)
+	scanner := bufio.NewScanner(resp.Body)
+	for len(events) < 3 && scanner.Scan() {
+		if !strings.HasPrefix(scanner.Text(), "data: ") {
+			continue
+		}
+		data := strings.TrimPrefix(scanner.Text(), "data: ")
+		var e server.Event
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			t.Errorf("invalid event %s: %v", data, err)
+		}
+		events = append(events, e)
+	}
+	if len(events) != 3 || events[0].Type != server.EVENT_CREATE_QUEUE ||
+		events[1].Type != "enqueue" || events[1].Ids[0] != id.String() ||
+		events[2].Type != server.EVENT_DELETE_QUEUE {
+		t.Errorf("unexpected events: %+v", events)
+	}
+}
+
+func TestManagerDashboard(t *testing.T) {
+	m := NewManager()
+	for _, path := range []string{"/dashboard/", "/dashboard/app.js", "/dashboard/style.css"} {
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK || rec.Body.Len() == 0 {
+			t.Errorf("GET %s returned %d", path, rec.Code)
+		}
+	}
+}
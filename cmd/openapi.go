@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding"
+	"net/http"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const OPENAPI_VERSION = "3.0.3"
+
+// openapi generates the spec from the routes of the manager,
+// the schemas are derived from the json tags of the body types
+func (m *Manager) openapi() map[string]interface{} {
+	schemas := make(map[string]interface{})
+	paths := make(map[string]interface{})
+	for _, route := range m.routes {
+		operation := map[string]interface{}{
+			"summary":     route.summary,
+			"operationId": operationId(route),
+		}
+		parameters := make([]interface{}, 0)
+		for _, part := range strings.Split(route.pattern, "/") {
+			if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+				parameters = append(parameters, map[string]interface{}{
+					"name":     strings.Trim(part, "{}"),
+					"in":       "path",
+					"required": true,
+					"schema":   map[string]interface{}{"type": "string"},
+				})
+			}
+		}
+		if route.request != nil && route.method == http.MethodGet {
+			parameters = append(parameters, queryParameters(reflect.TypeOf(route.request), schemas)...)
+		}
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+		if route.request != nil && route.method != http.MethodGet {
+			operation["requestBody"] = map[string]interface{}{
+				"content": jsonContent(schemaOf(reflect.TypeOf(route.request), schemas)),
+			}
+		}
+		resps := make(map[string]interface{})
+		for status, body := range route.responses {
+			resp := map[string]interface{}{"description": http.StatusText(status)}
+			if stream, ok := body.(eventStream); ok {
+				resp["content"] = map[string]interface{}{
+					"text/event-stream": map[string]interface{}{"schema": schemaOf(reflect.TypeOf(stream.event), schemas)},
+				}
+			} else if text, ok := body.(textContent); ok {
+				resp["content"] = map[string]interface{}{
+					text.mediaType: map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+				}
+			} else if body != nil {
+				resp["content"] = jsonContent(schemaOf(reflect.TypeOf(body), schemas))
+			}
+			resps[strconv.Itoa(status)] = resp
+		}
+		resps["default"] = map[string]interface{}{
+			"description": "error",
+			"content":     jsonContent(schemaOf(reflect.TypeOf(ErrorResponse{}), schemas)),
+		}
+		operation["responses"] = resps
+		path, ok := paths[route.pattern].(map[string]interface{})
+		if !ok {
+			path = make(map[string]interface{})
+			paths[route.pattern] = path
+		}
+		path[strings.ToLower(route.method)] = operation
+	}
+	return map[string]interface{}{
+		"openapi": OPENAPI_VERSION,
+		"info": map[string]interface{}{
+			"title":   "Queuic manager",
+			"version": "1",
+		},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": schemas},
+	}
+}
+
+// queryParameters describes the fields of a request struct as query parameters
+func queryParameters(t reflect.Type, schemas map[string]interface{}) []interface{} {
+	properties := make(map[string]interface{})
+	required := make([]interface{}, 0)
+	structProperties(t, properties, &required, schemas)
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parameters := make([]interface{}, 0, len(names))
+	for _, name := range names {
+		parameters = append(parameters, map[string]interface{}{
+			"name":     name,
+			"in":       "query",
+			"required": false,
+			"schema":   properties[name],
+		})
+	}
+	return parameters
+}
+
+// eventStream is a response of server sent events,
+// the data of every event is event as json
+type eventStream struct {
+	event interface{}
+}
+
+// textContent is a response which is not json, e.g. the metrics
+type textContent struct {
+	mediaType string
+}
+
+func (m *Manager) openapiHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	writeJSON(w, http.StatusOK, m.openapi())
+}
+
+// operationId is the handler name without the Handler suffix, e.g. getQueue
+func operationId(r route) string {
+	name := runtime.FuncForPC(reflect.ValueOf(r.handler).Pointer()).Name()
+	name = strings.TrimSuffix(name[strings.LastIndex(name, ".")+1:], "-fm")
+	return strings.TrimSuffix(name, "Handler")
+}
+
+func jsonContent(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+}
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// schemaOf returns the schema of t, named structs are added to schemas
+// and referenced
+func schemaOf(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Implements(textMarshalerType):
+		return map[string]interface{}{"type": "string"}
+	case t.Kind() == reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case t.Kind() == reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case t.Kind() == reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case t.Kind() == reflect.Struct:
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+		if _, ok := schemas[t.Name()]; ok {
+			return ref
+		}
+		properties := make(map[string]interface{})
+		required := make([]interface{}, 0)
+		// reserve the name before the fields for recursive types
+		schema := map[string]interface{}{"type": "object", "properties": properties}
+		schemas[t.Name()] = schema
+		structProperties(t, properties, &required, schemas)
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return ref
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+func structProperties(t reflect.Type, properties map[string]interface{}, required *[]interface{}, schemas map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" || !field.IsExported() {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" {
+			structProperties(field.Type, properties, required, schemas)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = schemaOf(field.Type, schemas)
+		if !strings.Contains(options, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dinifarb/queuic/pkg/server"
+)
+
+// specExamples are successful requests of every operation, run in order.
+// {name} is replaced by the test queue and {id} by the latest peeked id.
+var specExamples = []struct {
+	operationId string
+	body        interface{}
+}{
+	{"putQueue", QueueOptions{MaxLength: 10, TTL: "1h"}},
+	{"putQueue", QueueOptions{MaxLength: 20}},
+	{"getQueue", nil},
+	{"listQueues", nil},
+	{"stats", nil},
+	{"postMessage", MessageRequest{Message: "hello", Headers: map[string]string{"k": "v"}}},
+	{"browse", nil},
+	{"peek", PeekRequest{Max: 5}},
+	{"release", nil},
+	{"peek", nil},
+	{"accept", nil},
+	{"peek", nil},
+	{"enqueue", EnqueueRequest{QueueName: "spec-test", Message: "legacy"}},
+	{"createQueue", CreateQueueRequest{QueueName: "spec-test-legacy"}},
+	{"move", server.MoveRequest{Destination: "spec-test-legacy", MoveFilter: server.MoveFilter{Max: 1}}},
+	{"purge", PurgeRequest{InFlight: true}},
+	{"events", nil},
+	{"metrics", nil},
+	{"reload", nil},
+	{"openapi", nil},
+	{"deleteQueue", nil},
+}
+
+type specOperation struct {
+	method    string
+	pattern   string
+	responses map[string]interface{}
+}
+
+func TestOpenapiMatchesHandlers(t *testing.T) {
+	srv = server.NewQueuicServer("test")
+	m := NewManager()
+	m.Reload = func() error { return nil }
+	defer srv.DeleteQueue("spec-test")
+	defer srv.DeleteQueue("spec-test-legacy")
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	var spec map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("invalid spec: %v", err)
+	}
+	schemas := spec["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	operations := make(map[string]specOperation)
+	for pattern, path := range spec["paths"].(map[string]interface{}) {
+		for method, op := range path.(map[string]interface{}) {
+			op := op.(map[string]interface{})
+			operations[op["operationId"].(string)] = specOperation{
+				method:    strings.ToUpper(method),
+				pattern:   pattern,
+				responses: op["responses"].(map[string]interface{}),
+			}
+		}
+	}
+
+	tested := make(map[string]bool)
+	id := ""
+	for _, example := range specExamples {
+		op, ok := operations[example.operationId]
+		if !ok {
+			t.Errorf("operation %s is not in the spec", example.operationId)
+			continue
+		}
+		tested[example.operationId] = true
+		path := strings.NewReplacer("{name}", "spec-test", "{id}", id).Replace(op.pattern)
+		var body []byte
+		if example.body != nil {
+			body, _ = json.Marshal(example.body)
+		}
+		// streams end with the context
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, httptest.NewRequest(op.method, path, bytes.NewReader(body)).WithContext(ctx))
+		cancel()
+		resp, ok := op.responses[strconv.Itoa(rec.Code)].(map[string]interface{})
+		if !ok {
+			t.Errorf("%s %s returned undocumented status %d: %s", op.method, path, rec.Code, rec.Body.String())
+			continue
+		}
+		content, ok := resp["content"].(map[string]interface{})
+		if !ok {
+			if rec.Body.Len() > 0 {
+				t.Errorf("%s %s returned an undocumented body: %s", op.method, path, rec.Body.String())
+			}
+			continue
+		}
+		media, ok := content["application/json"].(map[string]interface{})
+		if !ok {
+			// streams are not validated
+			continue
+		}
+		schema := media["schema"].(map[string]interface{})
+		var v interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+			t.Errorf("%s %s returned invalid json: %v", op.method, path, err)
+			continue
+		}
+		if err := validate(schema, schemas, v); err != nil {
+			t.Errorf("%s %s response does not match the spec: %v", op.method, path, err)
+		}
+		if example.operationId == "peek" {
+			var peeked PeekResponse
+			json.Unmarshal(rec.Body.Bytes(), &peeked)
+			if len(peeked.Messages) > 0 {
+				id = peeked.Messages[0].Id
+			}
+		}
+	}
+	for operationId := range operations {
+		if !tested[operationId] {
+			t.Errorf("operation %s has no example", operationId)
+		}
+	}
+}
+
+// validate checks v against the subset of json schema the spec uses
+func validate(schema map[string]interface{}, schemas map[string]interface{}, v interface{}) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		return validate(schemas[strings.TrimPrefix(ref, "#/components/schemas/")].(map[string]interface{}), schemas, v)
+	}
+	switch schema["type"] {
+	case "string":
+		if _, ok := v.(string); !ok {
+			return fmt.Errorf("expected string, got %v", v)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("expected boolean, got %v", v)
+		}
+	case "integer", "number":
+		n, ok := v.(float64)
+		if !ok || (schema["type"] == "integer" && n != float64(int64(n))) {
+			return fmt.Errorf("expected %s, got %v", schema["type"], v)
+		}
+	case "array":
+		items, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("expected array, got %v", v)
+		}
+		for i, item := range items {
+			if err := validate(schema["items"].(map[string]interface{}), schemas, item); err != nil {
+				return fmt.Errorf("[%d]: %v", i, err)
+			}
+		}
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("expected object, got %v", v)
+		}
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := obj[name.(string)]; !ok {
+				return fmt.Errorf("missing required property %s", name)
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		for name, value := range obj {
+			property, ok := properties[name].(map[string]interface{})
+			if !ok {
+				property, ok = schema["additionalProperties"].(map[string]interface{})
+			}
+			if !ok {
+				return fmt.Errorf("undocumented property %s", name)
+			}
+			if err := validate(property, schemas, value); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
@@ -1,14 +1,27 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/dinifarb/mlog"
+	"github.com/dinifarb/queuic/pkg/proto"
+	"github.com/dinifarb/queuic/pkg/queue"
 	"github.com/dinifarb/queuic/pkg/server"
+	"github.com/dinifarb/queuic/pkg/trace"
 )
 
+// default time the running requests get to finish on SIGTERM or SIGINT
+const SHUTDOWN_TIMEOUT = 30 * time.Second
+
 var srv *server.QueuicServer
 
 func main() {
@@ -20,29 +33,188 @@ func main() {
     \__\_\\__,_|\___|\__,_|_|\___|							  
    `)
 	mlog.SetAppName("QUEUEIC")
-	logLevel := os.Getenv("LOG_LEVEL")
-	if strings.ToLower(logLevel) == "debug" {
-		mlog.SetLevel(mlog.Ldebug)
+	cfg, err := loadConfig(os.Args[1:], os.Getenv)
+	if err != nil {
+		mlog.Error("invalid configuration: %v", err)
+		os.Exit(1)
+	}
+	level, _ := logLevel(cfg.LogLevel)
+	mlog.SetLevel(level)
+	if cfg.Key == DEFAULT_KEY {
+		mlog.Warn("no key is configured use default key")
 	}
-	keyString := os.Getenv("QUEUEIC_KEY_STRING")
-	if keyString == "" {
-		mlog.Warn("QUEUEIC_KEY_STRING env variable is not set use default key")
-		keyString = "QUEUEIC"
+	srv = server.NewQueuicServer(cfg.Key)
+	cfg.apply(srv)
+	var exporter *trace.OTLPExporter
+	if cfg.OTLPEndpoint != "" {
+		mlog.Info("export spans to %s", cfg.OTLPEndpoint)
+		exporter = trace.NewOTLPExporter(cfg.OTLPEndpoint, "queuic")
+		srv.Tracer = &trace.Tracer{Exporter: exporter}
 	}
-	srv = server.NewQueuicServer(keyString)
 	if err := srv.LoadQueuesFromDisk(); err != nil {
 		mlog.Error("failed to load queues from disk: %v", err)
 		os.Exit(1)
 	}
+	if err := srv.ReconcileQueues(); err != nil {
+		mlog.Error("failed to apply the queue definitions: %v", err)
+		os.Exit(1)
+	}
+	reloader := &reloader{started: cfg}
 	manager := NewManager()
+	manager.server.Addr = cfg.HTTPAddress
+	manager.Reload = reloader.reload
 	go func() {
 		if err := manager.Start(); err != nil {
 			mlog.Error("failed to start manager: %v", err)
 			os.Exit(1)
 		}
 	}()
-	if err := srv.Serve(); err != nil {
-		mlog.Error("server error: %v", err)
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve()
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt, syscall.SIGHUP)
+wait:
+	for {
+		select {
+		case err := <-served:
+			mlog.Error("server error: %v", err)
+			os.Exit(1)
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				if err := reloader.reload(); err != nil {
+					mlog.Error("failed to reload the config: %v", err)
+				}
+				continue
+			}
+			mlog.Info("received %v, shutting down", sig)
+			break wait
+		}
+	}
+	if err := shutdown(manager, exporter, time.Duration(cfg.ShutdownTimeout)); err != nil {
+		mlog.Error("shutdown failed: %v", err)
 		os.Exit(1)
 	}
+	mlog.Info("shutdown complete")
+}
+
+// reloader reloads the config with the flags and env
+// variables the broker was started with
+type reloader struct {
+	mu      sync.Mutex
+	started Config
+}
+
+// reload applies the log level and the settings of the server,
+// the other keys are logged if they changed
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cfg, err := loadConfig(os.Args[1:], os.Getenv)
+	if err != nil {
+		return err
+	}
+	for _, key := range cfg.restartChanges(r.started) {
+		mlog.Warn("%s changed, it is applied when the broker is restarted", key)
+	}
+	level, _ := logLevel(cfg.LogLevel)
+	mlog.SetLevel(level)
+	if err := srv.Reload(cfg.settings()); err != nil {
+		return err
+	}
+	mlog.Info("reloaded the config")
+	return nil
+}
+
+// shutdown stops the manager and the server and closes the queues
+func shutdown(manager *Manager, exporter *trace.OTLPExporter, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := manager.Shutdown(ctx); err != nil {
+		mlog.Warn("failed to shut down the http interface: %v", err)
+	}
+	err := srv.Shutdown(ctx)
+	if exporter != nil {
+		if err := exporter.Flush(ctx); err != nil {
+			mlog.Warn("failed to export the last spans: %v", err)
+		}
+	}
+	return err
+}
+
+// parseAutoCreateRules parses rules like
+// "tenant-dlq;tenant-*:ttl=1h,max_length=1000,dead_letter=tenant-dlq"
+func parseAutoCreateRules(s string) ([]server.AutoCreateRule, error) {
+	rules := make([]server.AutoCreateRule, 0)
+	for _, r := range strings.Split(s, ";") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		pattern, settings, _ := strings.Cut(r, ":")
+		rule := server.AutoCreateRule{Pattern: pattern}
+		for _, setting := range strings.Split(settings, ",") {
+			if setting == "" {
+				continue
+			}
+			key, value, _ := strings.Cut(setting, "=")
+			if err := setQueueOption(&rule.Options, key, value); err != nil {
+				return nil, fmt.Errorf("rule %s: %v", pattern, err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	if err := checkDeadLetters(rules, nil); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// checkDeadLetters rejects a dead letter queue which would be auto created
+// with itself as dead letter queue, its expired items would never expire for
+// good. The first matching rule creates a queue which is not defined.
+func checkDeadLetters(rules []server.AutoCreateRule, defined map[proto.QueueName]bool) error {
+	for _, rule := range rules {
+		deadLetter := rule.Options.DeadLetter
+		if deadLetter == "" || defined[deadLetter] {
+			continue
+		}
+		for _, match := range rules {
+			if ok, _ := path.Match(match.Pattern, deadLetter.String()); !ok {
+				continue
+			}
+			if match.Options.DeadLetter == deadLetter {
+				return fmt.Errorf("rule %s: dead letter queue %s would be created by rule %s with itself as dead letter queue", rule.Pattern, deadLetter, match.Pattern)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+func setQueueOption(options *queue.Options, key, value string) error {
+	switch key {
+	case "ttl":
+		ttl, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid ttl: %v", err)
+		}
+		options.TTL = ttl
+	case "max_length":
+		maxLength, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid max_length: %v", err)
+		}
+		options.MaxLength = maxLength
+	case "dead_letter":
+		name, err := proto.NewQueueName(value)
+		if err != nil {
+			return fmt.Errorf("invalid dead_letter: %v", err)
+		}
+		options.DeadLetter = name
+	default:
+		return fmt.Errorf("unknown option %s", key)
+	}
+	return nil
 }
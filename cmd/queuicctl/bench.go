@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dinifarb/queuic/pkg/client"
+	"github.com/dinifarb/queuic/pkg/proto"
+	"github.com/google/uuid"
+)
+
+type benchResult struct {
+	Queue            string         `json:"queue"`
+	Producers        int            `json:"producers"`
+	Consumers        int            `json:"consumers"`
+	Messages         int            `json:"messages"`
+	MessageBytes     int            `json:"message_bytes"`
+	Duration         string         `json:"duration"`
+	Enqueued         int64          `json:"enqueued"`
+	EnqueueFailed    int64          `json:"enqueue_failed"`
+	Received         int64          `json:"received"`
+	Duplicates       int64          `json:"duplicates"`
+	Undrained        int64          `json:"undrained"`
+	Lost             int64          `json:"lost"`
+	Retransmits      uint64         `json:"retransmits"`
+	Timeouts         uint64         `json:"timeouts"`
+	EnqueuePerSecond float64        `json:"enqueue_per_second"`
+	ReceivePerSecond float64        `json:"receive_per_second"`
+	EnqueueLatency   latencySummary `json:"enqueue_latency"`
+	EndToEndLatency  latencySummary `json:"end_to_end_latency"`
+}
+
+type latencySummary struct {
+	P50 string `json:"p50"`
+	P90 string `json:"p90"`
+	P99 string `json:"p99"`
+	Max string `json:"max"`
+}
+
+type latencies struct {
+	mu     sync.Mutex
+	values []time.Duration
+}
+
+func (l *latencies) add(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.values = append(l.values, d)
+}
+
+func (l *latencies) summary() latencySummary {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.values) == 0 {
+		return latencySummary{P50: "-", P90: "-", P99: "-", Max: "-"}
+	}
+	sort.Slice(l.values, func(i, j int) bool { return l.values[i] < l.values[j] })
+	percentile := func(p float64) string {
+		i := int(p * float64(len(l.values)-1))
+		return l.values[i].Round(time.Microsecond).String()
+	}
+	return latencySummary{
+		P50: percentile(0.5),
+		P90: percentile(0.9),
+		P99: percentile(0.99),
+		Max: l.values[len(l.values)-1].Round(time.Microsecond).String(),
+	}
+}
+
+type benchOptions struct {
+	producers int
+	consumers int
+	messages  int
+	size      int
+	batch     int
+	linger    time.Duration
+	rate      int
+	queue     string
+	drain     time.Duration
+}
+
+// bench runs producers and consumers against a queue, every message
+// carries its send time in the first 8 bytes to measure the end to end latency
+func (c *ctl) bench(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	var o benchOptions
+	flags.IntVar(&o.producers, "producers", 1, "count of producers")
+	flags.IntVar(&o.consumers, "consumers", 1, "count of consumer workers")
+	flags.IntVar(&o.messages, "messages", 10000, "total count of messages")
+	flags.IntVar(&o.size, "size", 64, "bytes per message, at least 8")
+	flags.IntVar(&o.batch, "batch", client.DEFAULT_BATCH_SIZE, "max batch size of the producers")
+	flags.DurationVar(&o.linger, "linger", client.DEFAULT_LINGER, "linger time of the producers")
+	flags.IntVar(&o.rate, "rate", 0, "max messages per second of all producers, 0 is unlimited")
+	flags.StringVar(&o.queue, "queue", "", "queue to use, by default a temporary queue is created and deleted")
+	flags.DurationVar(&o.drain, "drain-timeout", 30*time.Second, "max time to wait for the consumers after the producers are done")
+	flags.Parse(args)
+	if o.producers <= 0 || o.consumers < 0 || o.messages <= 0 || o.size < 8 {
+		return fmt.Errorf("usage: bench [-producers n] [-consumers n] [-messages n] [-size bytes, at least 8]")
+	}
+	result, err := c.runBench(ctx, o)
+	if err != nil {
+		return err
+	}
+	if err := c.printBench(result); err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return errors.New("bench interrupted")
+	}
+	return nil
+}
+
+func (c *ctl) runBench(ctx context.Context, o benchOptions) (benchResult, error) {
+	name := o.queue
+	if name == "" {
+		name = "bench-" + uuid.NewString()[:8]
+		if err := c.client.CreateQueue(ctx, name); err != nil {
+			return benchResult{}, err
+		}
+		defer c.client.DeleteQueue(context.Background(), name)
+	}
+	// items which are already in the queue are not counted as undrained
+	initial, err := c.client.Size(ctx, name)
+	if err != nil {
+		return benchResult{}, err
+	}
+	result := benchResult{
+		Queue:        name,
+		Producers:    o.producers,
+		Consumers:    o.consumers,
+		Messages:     o.messages,
+		MessageBytes: o.size,
+	}
+	var enqueueLatency, endToEndLatency latencies
+	var received, duplicates int64
+	seen := sync.Map{}
+	allReceived := make(chan struct{})
+	consumeCtx, stopConsumers := context.WithCancel(ctx)
+	defer stopConsumers()
+	consumersDone := make(chan struct{})
+	if o.consumers > 0 {
+		consumer := client.NewConsumer(c.client, name, func(ctx context.Context, item proto.QueuicItem) error {
+			if len(item.Item) >= 8 {
+				sent := time.Unix(0, int64(binary.LittleEndian.Uint64(item.Item)))
+				endToEndLatency.add(time.Since(sent))
+			}
+			if _, loaded := seen.LoadOrStore(item.Id, true); loaded {
+				atomic.AddInt64(&duplicates, 1)
+				return nil
+			}
+			if atomic.AddInt64(&received, 1) == int64(o.messages) {
+				close(allReceived)
+			}
+			return nil
+		})
+		consumer.Workers = o.consumers
+		consumer.PollInterval = 10 * time.Millisecond
+		go func() {
+			defer close(consumersDone)
+			consumer.Run(consumeCtx)
+		}()
+	} else {
+		close(consumersDone)
+	}
+	start := time.Now()
+	var enqueued, failed int64
+	wg := sync.WaitGroup{}
+	for p := 0; p < o.producers; p++ {
+		count := o.messages / o.producers
+		if p < o.messages%o.producers {
+			count++
+		}
+		wg.Add(1)
+		go func(count int) {
+			defer wg.Done()
+			producer := client.NewProducer(c.client, name)
+			producer.BatchSize = o.batch
+			producer.Linger = o.linger
+			var interval time.Duration
+			if o.rate > 0 {
+				interval = time.Second * time.Duration(o.producers) / time.Duration(o.rate)
+			}
+			// every future is watched on its own, so the latency
+			// ends when the server acknowledged the item
+			acks := sync.WaitGroup{}
+			for i := 0; i < count && ctx.Err() == nil; i++ {
+				payload := make([]byte, o.size)
+				now := time.Now()
+				binary.LittleEndian.PutUint64(payload, uint64(now.UnixNano()))
+				f := producer.Send(payload, nil)
+				acks.Add(1)
+				go func() {
+					defer acks.Done()
+					<-f.Done()
+					if f.Err() != nil {
+						atomic.AddInt64(&failed, 1)
+						return
+					}
+					enqueueLatency.add(time.Since(now))
+					atomic.AddInt64(&enqueued, 1)
+				}()
+				if interval > 0 {
+					time.Sleep(interval)
+				}
+			}
+			producer.Close()
+			acks.Wait()
+		}(count)
+	}
+	wg.Wait()
+	enqueueDuration := time.Since(start)
+	if o.consumers > 0 && enqueued > 0 {
+		select {
+		case <-allReceived:
+		case <-time.After(o.drain):
+		case <-ctx.Done():
+		}
+	}
+	receiveDuration := time.Since(start)
+	stopConsumers()
+	<-consumersDone
+	result.Duration = receiveDuration.Round(time.Millisecond).String()
+	result.Enqueued = enqueued
+	result.EnqueueFailed = failed
+	result.Received = atomic.LoadInt64(&received)
+	result.Duplicates = atomic.LoadInt64(&duplicates)
+	if o.consumers > 0 {
+		// the items left in the queue after the drain timeout are not lost,
+		// only the enqueued items which are neither received nor left are
+		size, err := c.client.Size(context.Background(), name)
+		if err != nil {
+			return benchResult{}, fmt.Errorf("failed to get the size after the drain: %w", err)
+		}
+		if size > initial {
+			result.Undrained = int64(size - initial)
+		}
+		if lost := enqueued - result.Received - result.Undrained; lost > 0 {
+			result.Lost = lost
+		}
+	}
+	result.Retransmits = c.client.Retransmits()
+	result.Timeouts = c.client.Timeouts()
+	result.EnqueuePerSecond = float64(enqueued) / enqueueDuration.Seconds()
+	result.ReceivePerSecond = float64(result.Received) / receiveDuration.Seconds()
+	result.EnqueueLatency = enqueueLatency.summary()
+	result.EndToEndLatency = endToEndLatency.summary()
+	return result, nil
+}
+
+func (c *ctl) printBench(r benchResult) error {
+	rows := [][]string{
+		{"queue", r.Queue},
+		{"producers / consumers", fmt.Sprintf("%d / %d", r.Producers, r.Consumers)},
+		{"messages", fmt.Sprintf("%d x %d bytes", r.Messages, r.MessageBytes)},
+		{"duration", r.Duration},
+		{"enqueued / failed", fmt.Sprintf("%d / %d", r.Enqueued, r.EnqueueFailed)},
+		{"received / duplicates / undrained / lost", fmt.Sprintf("%d / %d / %d / %d", r.Received, r.Duplicates, r.Undrained, r.Lost)},
+		{"retransmits / timeouts", fmt.Sprintf("%d / %d", r.Retransmits, r.Timeouts)},
+		{"enqueue rate", fmt.Sprintf("%.0f msg/s", r.EnqueuePerSecond)},
+		{"receive rate", fmt.Sprintf("%.0f msg/s", r.ReceivePerSecond)},
+		{"enqueue latency p50 / p90 / p99 / max", formatLatency(r.EnqueueLatency)},
+		{"end to end latency p50 / p90 / p99 / max", formatLatency(r.EndToEndLatency)},
+	}
+	return c.print(r, []string{"METRIC", "VALUE"}, rows)
+}
+
+func formatLatency(l latencySummary) string {
+	return fmt.Sprintf("%s / %s / %s / %s", l.P50, l.P90, l.P99, l.Max)
+}
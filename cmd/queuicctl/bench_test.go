@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dinifarb/queuic/pkg/client"
+	"github.com/dinifarb/queuic/pkg/server"
+)
+
+func TestLatencySummary(t *testing.T) {
+	var l latencies
+	if s := l.summary(); s != (latencySummary{P50: "-", P90: "-", P99: "-", Max: "-"}) {
+		t.Errorf("expected dashes without latencies, got %+v", s)
+	}
+	// added in reverse order, the summary sorts them
+	for i := 100; i > 0; i-- {
+		l.add(time.Duration(i) * time.Millisecond)
+	}
+	want := latencySummary{P50: "50ms", P90: "90ms", P99: "99ms", Max: "100ms"}
+	if s := l.summary(); s != want {
+		t.Errorf("expected %+v, got %+v", want, s)
+	}
+	if s := formatLatency(want); s != "50ms / 90ms / 99ms / 100ms" {
+		t.Errorf("unexpected format: %s", s)
+	}
+}
+
+func TestBenchLatency(t *testing.T) {
+	svr := server.NewQueuicServer("test")
+	svr.Port = 9542
+	svr.DataDir = t.TempDir()
+	go svr.Serve()
+	defer svr.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+	// every response is delayed, the enqueue latency includes the slow
+	// ack and the end to end latency the slow peek after it
+	proxy := newSlowProxy(t, fmt.Sprintf("localhost:%d", svr.Port), 20*time.Millisecond)
+	defer proxy.Close()
+	c, err := client.New(proxy.LocalAddr().String(), "test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	cli := &ctl{client: c}
+	result, err := cli.runBench(context.Background(), benchOptions{
+		producers: 1,
+		consumers: 1,
+		messages:  40,
+		size:      8,
+		batch:     client.DEFAULT_BATCH_SIZE,
+		linger:    time.Millisecond,
+		rate:      200,
+		drain:     5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("bench failed: %v", err)
+	}
+	if result.Enqueued != 40 || result.Received != 40 {
+		t.Fatalf("expected 40 enqueued and received messages, got %+v", result)
+	}
+	for _, p := range []struct{ enqueue, endToEnd string }{
+		{result.EnqueueLatency.P50, result.EndToEndLatency.P50},
+		{result.EnqueueLatency.P90, result.EndToEndLatency.P90},
+	} {
+		enqueue, _ := time.ParseDuration(p.enqueue)
+		endToEnd, _ := time.ParseDuration(p.endToEnd)
+		if enqueue < 20*time.Millisecond || enqueue > endToEnd {
+			t.Errorf("expected enqueue latency between the ack delay and the end to end latency, got %s and %s", p.enqueue, p.endToEnd)
+		}
+	}
+}
+
+func TestBenchUndrained(t *testing.T) {
+	svr := server.NewQueuicServer("test")
+	svr.Port = 9543
+	svr.DataDir = t.TempDir()
+	go svr.Serve()
+	defer svr.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+	// the slow consumer can not drain the queue within the drain timeout
+	proxy := newSlowProxy(t, fmt.Sprintf("localhost:%d", svr.Port), 20*time.Millisecond)
+	defer proxy.Close()
+	c, err := client.New(proxy.LocalAddr().String(), "test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	cli := &ctl{client: c}
+	result, err := cli.runBench(context.Background(), benchOptions{
+		producers: 1,
+		consumers: 1,
+		messages:  100,
+		size:      8,
+		batch:     client.DEFAULT_BATCH_SIZE,
+		linger:    time.Millisecond,
+		drain:     50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("bench failed: %v", err)
+	}
+	if result.Enqueued != 100 || result.Undrained == 0 || result.Received+result.Undrained != 100 || result.Lost != 0 {
+		t.Errorf("expected the items left in the queue as undrained and none lost, got %+v", result)
+	}
+}
+
+// newSlowProxy forwards packets to target and delays the responses
+func newSlowProxy(t *testing.T, target string, delay time.Duration) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	targetAddr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	go func() {
+		upstreams := make(map[string]*net.UDPConn)
+		buff := make([]byte, server.MAX_PACKET_LENGTH)
+		for {
+			n, addr, err := conn.ReadFromUDP(buff)
+			if err != nil {
+				return
+			}
+			upstream, ok := upstreams[addr.String()]
+			if !ok {
+				upstream, err = net.DialUDP("udp", nil, targetAddr)
+				if err != nil {
+					return
+				}
+				upstreams[addr.String()] = upstream
+				go func(addr *net.UDPAddr) {
+					defer upstream.Close()
+					for {
+						resp := make([]byte, server.MAX_PACKET_LENGTH)
+						n, err := upstream.Read(resp)
+						if err != nil {
+							return
+						}
+						time.AfterFunc(delay, func() {
+							conn.WriteToUDP(resp[:n], addr)
+						})
+					}
+				}(addr)
+			}
+			upstream.Write(buff[:n])
+		}
+	}()
+	return conn
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dinifarb/queuic/pkg/trace"
+)
+
+type spanOutput struct {
+	TraceId    string            `json:"trace_id"`
+	SpanId     string            `json:"span_id"`
+	ParentId   string            `json:"parent_id,omitempty"`
+	Name       string            `json:"name"`
+	Start      time.Time         `json:"start"`
+	Duration   string            `json:"duration"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// collect is a stand-in for an OTLP collector which prints the received spans
+func (c *ctl) collect(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("collect", flag.ExitOnError)
+	listen := flags.String("listen", "localhost:4318", "address to receive OTLP/HTTP json on")
+	flags.Parse(args)
+	var mu sync.Mutex
+	enc := json.NewEncoder(os.Stdout)
+	// spans are printed as they arrive, so the columns have a fixed width
+	const format = "%-32s  %-16s  %-16s  %-8s  %12s  %s\n"
+	if c.output != "json" {
+		fmt.Printf(format, "TRACE", "SPAN", "PARENT", "NAME", "DURATION", "ATTRIBUTES")
+	}
+	collector := &trace.Collector{OnSpan: func(span trace.SpanData) {
+		out := spanOutput{
+			TraceId:    span.Context.TraceID.String(),
+			SpanId:     span.Context.SpanID.String(),
+			Name:       span.Name,
+			Start:      span.StartTime,
+			Duration:   span.EndTime.Sub(span.StartTime).String(),
+			Attributes: span.Attributes,
+			Error:      span.Error,
+		}
+		if span.Parent != (trace.SpanID{}) {
+			out.ParentId = span.Parent.String()
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if c.output == "json" {
+			enc.Encode(out)
+			return
+		}
+		attributes := formatHeaders(out.Attributes)
+		if out.Error != "" {
+			attributes += " error: " + out.Error
+		}
+		fmt.Printf(format, out.TraceId, out.SpanId, orDash(out.ParentId), out.Name, out.Duration, attributes)
+	}}
+	mux := http.NewServeMux()
+	mux.Handle("/v1/traces", collector)
+	srv := &http.Server{Addr: *listen, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	fmt.Fprintf(os.Stderr, "receive spans on http://%s/v1/traces\n", *listen)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dinifarb/queuic/pkg/client"
+	"github.com/dinifarb/queuic/pkg/proto"
+	"github.com/dinifarb/queuic/pkg/server"
+	"github.com/google/uuid"
+)
+
+func (c *ctl) create(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: create <queue>")
+	}
+	if c.http != "" {
+		return c.post("/createQueue", map[string]string{"queueName": args[0]}, nil)
+	}
+	return c.client.CreateQueue(ctx, args[0])
+}
+
+func (c *ctl) delete(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: delete <queue>")
+	}
+	return c.client.DeleteQueue(ctx, args[0])
+}
+
+func (c *ctl) list(ctx context.Context, args []string) error {
+	names, err := c.client.ListQueues(ctx)
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, len(names))
+	for i, name := range names {
+		rows[i] = []string{name}
+	}
+	return c.print(names, []string{"QUEUE"}, rows)
+}
+
+func (c *ctl) stats(ctx context.Context, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: stats [queue]")
+	}
+	queue := ""
+	if len(args) == 1 {
+		queue = args[0]
+	}
+	var stats []server.QueueStats
+	var err error
+	if c.http != "" {
+		stats, err = c.httpStats(queue)
+	} else {
+		stats, err = c.client.Stats(ctx, queue)
+	}
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, len(stats))
+	for i, s := range stats {
+		rows[i] = []string{s.QueueName, fmt.Sprint(s.Size), fmt.Sprint(s.Enequeued), fmt.Sprint(s.Dequeued),
+			fmt.Sprintf("%.1f", s.EnqueueRate1m), fmt.Sprintf("%.1f", s.DequeueRate1m), seconds(s.OldestAge),
+			seconds(s.AvgTimeInQueue), seconds(s.AvgProcessing)}
+	}
+	return c.print(stats, []string{"QUEUE", "SIZE", "ENQUEUED", "DEQUEUED", "ENQ/S", "DEQ/S", "OLDEST", "AVG WAIT", "AVG PROCESSING"}, rows)
+}
+
+// seconds formats seconds as a rounded duration like 1.5s or 2m3s
+func seconds(s float64) string {
+	d := time.Duration(s * float64(time.Second))
+	if d >= time.Second {
+		return d.Round(100 * time.Millisecond).String()
+	}
+	return d.Round(time.Millisecond).String()
+}
+
+func (c *ctl) size(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: size <queue>")
+	}
+	size, err := c.client.Size(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return c.print(map[string]int{"size": size}, []string{"SIZE"}, [][]string{{fmt.Sprint(size)}})
+}
+
+func (c *ctl) purge(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("purge", flag.ExitOnError)
+	inFlight := flags.Bool("in-flight", false, "remove the in flight items too")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: purge [-in-flight] <queue>")
+	}
+	n, err := c.client.Purge(ctx, flags.Arg(0), *inFlight)
+	if err != nil {
+		return err
+	}
+	return c.print(map[string]int{"purged": n}, []string{"PURGED"}, [][]string{{fmt.Sprint(n)}})
+}
+
+func (c *ctl) enqueue(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("enqueue", flag.ExitOnError)
+	var headers headerFlag
+	flags.Var(&headers, "H", "header as key=value, can be repeated")
+	lines := flags.Bool("lines", false, "enqueue every line as its own item")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		return fmt.Errorf("usage: enqueue [-H key=value] [-lines] <queue> [file...]")
+	}
+	queue := flags.Arg(0)
+	items, err := readItems(flags.Args()[1:], *lines)
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(items))
+	ids := make([]string, 0, len(items))
+	for _, item := range items {
+		var id uuid.UUID
+		if c.http != "" {
+			id, err = c.httpEnqueue(queue, item, headers)
+		} else {
+			id, err = c.client.Enqueue(ctx, queue, item, headers)
+		}
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id.String())
+		rows = append(rows, []string{id.String(), fmt.Sprint(len(item))})
+	}
+	return c.print(ids, []string{"ID", "BYTES"}, rows)
+}
+
+func (c *ctl) peek(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("peek", flag.ExitOnError)
+	count := flags.Int("n", 1, "max count of items to peek")
+	accept := flags.Bool("ack", false, "accept the items after printing them")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: peek [-n count] [-ack] <queue>")
+	}
+	queue := flags.Arg(0)
+	items, err := c.client.PeekBatch(ctx, queue, *count)
+	if err != nil {
+		return err
+	}
+	if err := c.printItems(items); err != nil {
+		return err
+	}
+	if *accept {
+		return c.client.AcceptBatch(ctx, queue, itemIds(items))
+	}
+	return nil
+}
+
+func (c *ctl) browse(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("browse", flag.ExitOnError)
+	offset := flags.Int("offset", 0, "index of the first item")
+	limit := flags.Int("n", 100, "max count of items")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: browse [-offset n] [-n count] <queue>")
+	}
+	items, err := c.browseItems(ctx, flags.Arg(0), *offset, *limit)
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, len(items))
+	for i, item := range items {
+		state := "waiting"
+		if item.InFlight {
+			state = "in flight"
+		}
+		rows[i] = []string{item.Id, fmt.Sprint(item.Size), item.EnqueuedAt.Format(time.RFC3339), state, formatHeaders(item.Headers)}
+	}
+	return c.print(items, []string{"ID", "BYTES", "ENQUEUED", "STATE", "HEADERS"}, rows)
+}
+
+// browseItems requests pages until it has limit items or the end of the queue,
+// the server cuts pages to fit in a packet
+func (c *ctl) browseItems(ctx context.Context, queue string, offset int, limit int) ([]server.BrowsedItem, error) {
+	items := make([]server.BrowsedItem, 0, limit)
+	for len(items) < limit {
+		n := limit - len(items)
+		if n > server.MAX_BROWSE_LIMIT {
+			n = server.MAX_BROWSE_LIMIT
+		}
+		page, err := c.client.Browse(ctx, queue, offset+len(items), n)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, page.Items...)
+		if len(page.Items) == 0 || page.Offset+len(page.Items) >= page.Total {
+			break
+		}
+	}
+	return items, nil
+}
+
+func (c *ctl) accept(ctx context.Context, args []string) error {
+	queue, ids, err := queueAndIds("accept", args)
+	if err != nil {
+		return err
+	}
+	return c.client.AcceptBatch(ctx, queue, ids)
+}
+
+func (c *ctl) release(ctx context.Context, args []string) error {
+	queue, ids, err := queueAndIds("release", args)
+	if err != nil {
+		return err
+	}
+	return c.client.ReleaseBatch(ctx, queue, ids)
+}
+
+func (c *ctl) move(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("move", flag.ExitOnError)
+	var headers headerFlag
+	flags.Var(&headers, "H", "move only items with the header key=value, can be repeated")
+	max := flags.Int("n", 0, "max count of items to move, 0 moves all")
+	flags.Parse(args)
+	if flags.NArg() < 2 {
+		return fmt.Errorf("usage: move [-H key=value] [-n count] <source> <destination> [id...]")
+	}
+	filter := server.MoveFilter{Headers: headers, Max: *max}
+	if flags.NArg() > 2 {
+		_, ids, err := queueAndIds("move", flags.Args()[1:])
+		if err != nil {
+			return err
+		}
+		filter.Ids = ids
+	}
+	n, err := c.client.Move(ctx, flags.Arg(0), flags.Arg(1), filter)
+	if err != nil {
+		return err
+	}
+	return c.print(map[string]int{"moved": n}, []string{"MOVED"}, [][]string{{fmt.Sprint(n)}})
+}
+
+func (c *ctl) tail(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: tail <queue>")
+	}
+	if _, err := c.client.Size(ctx, args[0]); err != nil {
+		return err
+	}
+	consumer := client.NewConsumer(c.client, args[0], func(ctx context.Context, item proto.QueuicItem) error {
+		return c.printItems([]proto.QueuicItem{item})
+	})
+	return consumer.Run(ctx)
+}
+
+func queueAndIds(command string, args []string) (string, []uuid.UUID, error) {
+	if len(args) < 2 {
+		return "", nil, fmt.Errorf("usage: %s <queue> <id...>", command)
+	}
+	ids := make([]uuid.UUID, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		id, err := uuid.Parse(arg)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid id %s: %v", arg, err)
+		}
+		ids = append(ids, id)
+	}
+	return args[0], ids, nil
+}
+
+func readItems(files []string, lines bool) ([][]byte, error) {
+	contents := make([][]byte, 0, len(files))
+	if len(files) == 0 {
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read stdin: %v", err)
+		}
+		contents = append(contents, b)
+	}
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		contents = append(contents, b)
+	}
+	if !lines {
+		return contents, nil
+	}
+	items := make([][]byte, 0)
+	for _, content := range contents {
+		for _, line := range bytes.Split(content, []byte("\n")) {
+			if len(bytes.TrimSpace(line)) > 0 {
+				items = append(items, line)
+			}
+		}
+	}
+	return items, nil
+}
+
+func itemIds(items []proto.QueuicItem) []uuid.UUID {
+	ids := make([]uuid.UUID, len(items))
+	for i, item := range items {
+		ids[i] = item.Id
+	}
+	return ids
+}
+
+type headerFlag map[string]string
+
+func (h *headerFlag) String() string {
+	return fmt.Sprint(map[string]string(*h))
+}
+
+func (h *headerFlag) Set(s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("header must be key=value")
+	}
+	if *h == nil {
+		*h = make(headerFlag)
+	}
+	(*h)[key] = value
+	return nil
+}
+
+// httpEnqueue posts the item to the messages of the queue and returns its id
+func (c *ctl) httpEnqueue(queue string, item []byte, headers map[string]string) (uuid.UUID, error) {
+	var resp struct {
+		Id string `json:"id"`
+	}
+	body := map[string]interface{}{"message": string(item), "headers": headers}
+	if err := c.post("/queues/"+url.PathEscape(queue)+"/messages", body, &resp); err != nil {
+		return uuid.Nil, err
+	}
+	id, err := uuid.Parse(resp.Id)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("invalid enqueue response: %v", err)
+	}
+	return id, nil
+}
+
+// post sends body as json and decodes the response into v if it is not nil
+func (c *ctl) post(path string, body interface{}, v interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	httpClient := http.Client{Timeout: c.timeout}
+	resp, err := httpClient.Post(strings.TrimSuffix(c.http, "/")+path, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("http %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if v == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("invalid response: %v", err)
+	}
+	return nil
+}
+
+func (c *ctl) httpStats(queue string) ([]server.QueueStats, error) {
+	httpClient := http.Client{Timeout: c.timeout}
+	resp, err := httpClient.Get(strings.TrimSuffix(c.http, "/") + "/stats")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("http %s", resp.Status)
+	}
+	var stats []server.QueueStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return nil, fmt.Errorf("invalid stats response: %v", err)
+	}
+	if queue == "" {
+		return stats, nil
+	}
+	for _, s := range stats {
+		if s.QueueName == queue {
+			return []server.QueueStats{s}, nil
+		}
+	}
+	return nil, errors.New("queue does not exist")
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dinifarb/queuic/pkg/client"
+	"github.com/dinifarb/queuic/pkg/server"
+	"github.com/google/uuid"
+)
+
+func TestReadItems(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first")
+	second := filepath.Join(dir, "second")
+	os.WriteFile(first, []byte("one\n\ntwo\n"), 0644)
+	os.WriteFile(second, []byte("three"), 0644)
+	items, err := readItems([]string{first, second}, false)
+	if err != nil || len(items) != 2 || string(items[0]) != "one\n\ntwo\n" {
+		t.Errorf("expected one item per file, got %q, %v", items, err)
+	}
+	// with -lines every non empty line is an item
+	items, err = readItems([]string{first, second}, true)
+	if err != nil || len(items) != 3 || string(items[0]) != "one" || string(items[1]) != "two" || string(items[2]) != "three" {
+		t.Errorf("expected one item per line, got %q, %v", items, err)
+	}
+	if _, err := readItems([]string{filepath.Join(dir, "missing")}, true); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+}
+
+func TestQueueAndIds(t *testing.T) {
+	id := uuid.New()
+	queue, ids, err := queueAndIds("accept", []string{"orders", id.String()})
+	if err != nil || queue != "orders" || len(ids) != 1 || ids[0] != id {
+		t.Errorf("unexpected result: %s, %v, %v", queue, ids, err)
+	}
+	if _, _, err := queueAndIds("accept", []string{"orders"}); err == nil || !strings.Contains(err.Error(), "usage: accept") {
+		t.Errorf("expected usage error, got %v", err)
+	}
+	if _, _, err := queueAndIds("accept", []string{"orders", "not-an-id"}); err == nil {
+		t.Errorf("expected an error for an invalid id")
+	}
+}
+
+func TestHeaderFlag(t *testing.T) {
+	var headers headerFlag
+	for _, s := range []string{"tenant=a", "filter=x=y", "tenant=b"} {
+		if err := headers.Set(s); err != nil {
+			t.Errorf("failed to set %s: %v", s, err)
+		}
+	}
+	if !reflect.DeepEqual(map[string]string(headers), map[string]string{"tenant": "b", "filter": "x=y"}) {
+		t.Errorf("unexpected headers: %v", headers)
+	}
+	if err := headers.Set("tenant"); err == nil {
+		t.Errorf("expected an error without =")
+	}
+}
+
+func TestBrowseItems(t *testing.T) {
+	svr := server.NewQueuicServer("test")
+	svr.Port = 9541
+	svr.DataDir = t.TempDir()
+	go svr.Serve()
+	defer svr.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+
+	ctx := context.Background()
+	c, err := client.New(fmt.Sprintf("localhost:%d", svr.Port), "test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := c.CreateQueue(ctx, "browse"); err != nil {
+		t.Fatalf("failed to create queue: %v", err)
+	}
+	// more items than fit in a single page
+	ids := make([]string, 60)
+	for i := range ids {
+		id, err := c.Enqueue(ctx, "browse", []byte(fmt.Sprint(i)), map[string]string{"index": fmt.Sprint(i)})
+		if err != nil {
+			t.Fatalf("failed to enqueue: %v", err)
+		}
+		ids[i] = id.String()
+	}
+	cli := &ctl{client: c}
+	for _, tc := range []struct {
+		offset int
+		limit  int
+		want   []string
+	}{
+		{0, 100, ids},
+		{0, 45, ids[:45]},
+		{50, 100, ids[50:]},
+		{60, 100, []string{}},
+	} {
+		items, err := cli.browseItems(ctx, "browse", tc.offset, tc.limit)
+		if err != nil {
+			t.Errorf("failed to browse from %d: %v", tc.offset, err)
+			continue
+		}
+		got := make([]string, len(items))
+		for i, item := range items {
+			got[i] = item.Id
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("browse from %d with limit %d: expected %d items, got %d", tc.offset, tc.limit, len(tc.want), len(got))
+		}
+	}
+}
+
+func TestEnqueue(t *testing.T) {
+	svr := server.NewQueuicServer("test")
+	svr.Port = 9544
+	svr.DataDir = t.TempDir()
+	svr.CreateQueue("orders")
+	go svr.Serve()
+	defer svr.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+	c, err := client.New(fmt.Sprintf("localhost:%d", svr.Port), "test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	// the http manager is faked, it only answers posted messages
+	httpId := uuid.New()
+	var posted map[string]interface{}
+	manager := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/queues/orders/messages" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&posted)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"id": httpId.String()})
+	}))
+	defer manager.Close()
+	file := filepath.Join(t.TempDir(), "items")
+	os.WriteFile(file, []byte("first"), 0644)
+
+	var ids []string
+	out := captureStdout(t, func() error {
+		return (&ctl{client: c, output: "json"}).enqueue(context.Background(), []string{"orders", file})
+	})
+	if err := json.Unmarshal([]byte(out), &ids); err != nil || len(ids) != 1 {
+		t.Fatalf("unexpected udp output %q: %v", out, err)
+	}
+	if item, err := c.Peek(context.Background(), "orders"); err != nil || item.Id.String() != ids[0] {
+		t.Errorf("expected the printed id %s to be enqueued, got %v, %v", ids[0], item.Id, err)
+	}
+	out = captureStdout(t, func() error {
+		return (&ctl{client: c, http: manager.URL, output: "json"}).enqueue(context.Background(), []string{"-H", "tenant=a", "orders", file})
+	})
+	if err := json.Unmarshal([]byte(out), &ids); err != nil || len(ids) != 1 || ids[0] != httpId.String() {
+		t.Errorf("expected the id %s of the http response, got %q, %v", httpId, out, err)
+	}
+	if posted["message"] != "first" || !reflect.DeepEqual(posted["headers"], map[string]interface{}{"tenant": "a"}) {
+		t.Errorf("unexpected posted message: %v", posted)
+	}
+}
+
+// captureStdout returns what f prints, it fails the test if f fails
+func captureStdout(t *testing.T, f func() error) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	err = f()
+	os.Stdout = stdout
+	w.Close()
+	out, _ := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("command failed: %v", err)
+	}
+	return string(out)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/dinifarb/mlog"
+	"github.com/dinifarb/queuic/pkg/client"
+	"github.com/dinifarb/queuic/pkg/server"
+)
+
+const usage = `usage: queuicctl [flags] <command> [args]
+
+commands:
+  create <queue>                create a queue
+  delete <queue>                delete a queue
+  list                          list all queues
+  stats [queue]                 show the stats of a queue or of all queues
+  size <queue>                  show the count of items of a queue
+  purge <queue>                 remove all items which are not in flight, -in-flight removes them too
+  enqueue <queue> [file...]     enqueue stdin or every file as an item
+  browse <queue>                list items without peeking them
+  peek <queue>                  peek items, they stay in flight
+  accept <queue> <id...>        accept peeked items
+  release <queue> <id...>       release peeked items
+  move <source> <destination> [id...]
+                                move waiting items to another queue
+  tail <queue>                  consume and print items until interrupted
+  bench                         run producers and consumers and report throughput and latency
+  collect                       receive OTLP spans like a collector and print them, -listen sets the address
+
+flags:
+`
+
+type ctl struct {
+	client  *client.Client
+	http    string
+	output  string
+	timeout time.Duration
+}
+
+func main() {
+	mlog.SetAppName("QUEUICCTL")
+	mlog.SetLevel(mlog.Lwarn)
+	flags := flag.NewFlagSet("queuicctl", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+	addr := flags.String("addr", fmt.Sprintf("localhost:%d", server.DEFAULT_PORT), "udp address of the server")
+	key := flags.String("key", envOrDefault("QUEUEIC_KEY_STRING", "QUEUEIC"), "key string of the server, defaults to QUEUEIC_KEY_STRING")
+	httpAddr := flags.String("http", "", "url of the http manager, e.g. http://localhost:8080, used by create, enqueue and stats if set")
+	output := flags.String("o", "table", "output format, table or json")
+	timeout := flags.Duration("timeout", client.DEFAULT_TIMEOUT, "timeout of a single request attempt")
+	retries := flags.Int("retries", client.DEFAULT_RETRIES, "count of retransmits of a request without response")
+	flags.Parse(os.Args[1:])
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *output != "table" && *output != "json" {
+		fail(fmt.Errorf("unknown output format %s", *output))
+	}
+	c, err := client.New(*addr, *key)
+	if err != nil {
+		fail(err)
+	}
+	c.Timeout = *timeout
+	c.Retries = *retries
+	cli := &ctl{client: c, http: *httpAddr, output: *output, timeout: *timeout}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := cli.run(ctx, flags.Arg(0), flags.Args()[1:]); err != nil {
+		fail(err)
+	}
+}
+
+func (c *ctl) run(ctx context.Context, command string, args []string) error {
+	switch command {
+	case "create":
+		return c.create(ctx, args)
+	case "delete":
+		return c.delete(ctx, args)
+	case "list":
+		return c.list(ctx, args)
+	case "stats":
+		return c.stats(ctx, args)
+	case "size":
+		return c.size(ctx, args)
+	case "purge":
+		return c.purge(ctx, args)
+	case "enqueue":
+		return c.enqueue(ctx, args)
+	case "browse":
+		return c.browse(ctx, args)
+	case "peek":
+		return c.peek(ctx, args)
+	case "accept":
+		return c.accept(ctx, args)
+	case "release":
+		return c.release(ctx, args)
+	case "move":
+		return c.move(ctx, args)
+	case "tail":
+		return c.tail(ctx, args)
+	case "bench":
+		return c.bench(ctx, args)
+	case "collect":
+		return c.collect(ctx, args)
+	default:
+		return fmt.Errorf("unknown command %s, see queuicctl -h", command)
+	}
+}
+
+func envOrDefault(name string, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "error: %v\n", err)
+	os.Exit(1)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"unicode/utf8"
+
+	"github.com/dinifarb/queuic/pkg/proto"
+)
+
+type itemOutput struct {
+	Id      string            `json:"id"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Item    string            `json:"item"`
+	// Encoding is base64 if the item is not valid utf-8
+	Encoding string `json:"encoding,omitempty"`
+}
+
+func (c *ctl) print(v interface{}, header []string, rows [][]string) error {
+	if c.output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+func (c *ctl) printItems(items []proto.QueuicItem) error {
+	outputs := make([]itemOutput, len(items))
+	rows := make([][]string, len(items))
+	for i, item := range items {
+		out := itemOutput{Id: item.Id.String(), Headers: item.Headers, Item: string(item.Item)}
+		if !utf8.Valid(item.Item) {
+			out.Item = base64.StdEncoding.EncodeToString(item.Item)
+			out.Encoding = "base64"
+		}
+		outputs[i] = out
+		rows[i] = []string{out.Id, formatHeaders(item.Headers), strings.ReplaceAll(out.Item, "\n", "\\n")}
+	}
+	if c.output == "json" {
+		// one object per line, so tail can be piped
+		enc := json.NewEncoder(os.Stdout)
+		for _, out := range outputs {
+			if err := enc.Encode(out); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return c.print(outputs, []string{"ID", "HEADERS", "ITEM"}, rows)
+}
+
+func formatHeaders(headers map[string]string) string {
+	if len(headers) == 0 {
+		return "-"
+	}
+	b, _ := json.Marshal(headers)
+	return string(b)
+}
@@ -0,0 +1,424 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/dinifarb/queuic/pkg/proto"
+	"github.com/dinifarb/queuic/pkg/server"
+	"github.com/dinifarb/queuic/pkg/trace"
+	"github.com/google/uuid"
+)
+
+const (
+	DEFAULT_TIMEOUT = 2 * time.Second
+	DEFAULT_RETRIES = 3
+)
+
+var (
+	ErrTimeout       = errors.New("request timed out")
+	ErrBadRequest    = errors.New("bad request")
+	ErrQueueNotFound = errors.New("queue does not exist")
+	ErrQueueExists   = errors.New("queue already exists")
+	ErrQueueEmpty    = errors.New("queue is empty")
+	ErrQueueFull     = errors.New("queue is full")
+	// ErrBusy is returned when the server did not handle the
+	// request because it was saturated, it can be sent again
+	ErrBusy = errors.New("server is busy")
+	// ErrItemNotFound is returned when an accepted or
+	// released item is not in flight
+	ErrItemNotFound = errors.New("item is not in flight")
+)
+
+// ServerError is the error returned by the server, use errors.Is
+// with the Err variables of this package to check its kind.
+type ServerError struct {
+	Code    proto.ErrorCode
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("server error: %s", e.Message)
+}
+
+func (e *ServerError) Unwrap() error {
+	switch e.Code {
+	case proto.ERR_BAD_REQUEST:
+		return ErrBadRequest
+	case proto.ERR_QUEUE_NOT_FOUND:
+		return ErrQueueNotFound
+	case proto.ERR_QUEUE_EXISTS:
+		return ErrQueueExists
+	case proto.ERR_QUEUE_EMPTY:
+		return ErrQueueEmpty
+	case proto.ERR_QUEUE_FULL:
+		return ErrQueueFull
+	case proto.ERR_BUSY:
+		return ErrBusy
+	case proto.ERR_ITEM_NOT_FOUND:
+		return ErrItemNotFound
+	default:
+		return nil
+	}
+}
+
+// Client talks to a queuic server over the encrypted udp protocol.
+// Requests without response are sent again up to Retries times, the
+// server answers duplicates of a request with the same response.
+type Client struct {
+	// Timeout is the time to wait for the response of a single attempt
+	Timeout     time.Duration
+	Retries     int
+	addr        *net.UDPAddr
+	key         [32]byte
+	retransmits uint64
+	timeouts    uint64
+}
+
+// New creates a client for the server at addr, e.g. "localhost:9523",
+// with the same key string as the server.
+func New(addr string, key string) (*Client, error) {
+	udpAddr, err := net.ResolveUDPAddr(server.NETWORK_TYPE, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", addr, err)
+	}
+	return &Client{
+		Timeout: DEFAULT_TIMEOUT,
+		Retries: DEFAULT_RETRIES,
+		addr:    udpAddr,
+		key:     sha256.Sum256([]byte(key)),
+	}, nil
+}
+
+// Enqueue adds a new item to the queue and returns its id
+func (c *Client) Enqueue(ctx context.Context, queue string, item []byte, headers map[string]string) (uuid.UUID, error) {
+	i := proto.QueuicItem{Id: uuid.New(), Item: item, Headers: headers}
+	if i.Item == nil {
+		i.Item = []byte{}
+	}
+	_, err := c.request(ctx, proto.ENQUEUE, queue, i, nil, proto.ENQUEUE_ACK)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return i.Id, nil
+}
+
+// EnqueueBatch adds all items atomically, items without id get a new one.
+// Items without traceparent header get the trace context of ctx.
+func (c *Client) EnqueueBatch(ctx context.Context, queue string, items []proto.QueuicItem) error {
+	for i := range items {
+		if items[i].Id == uuid.Nil {
+			items[i].Id = uuid.New()
+		}
+	}
+	if _, ok := trace.SpanContextFromContext(ctx); ok {
+		items = append([]proto.QueuicItem(nil), items...)
+		for i := range items {
+			items[i].Headers = trace.Inject(ctx, items[i].Headers)
+		}
+	}
+	_, err := c.request(ctx, proto.ENQUEUE_BATCH, queue, proto.QueuicItem{}, items, proto.ENQUEUE_BATCH_ACK)
+	return err
+}
+
+// Peek returns the next item, it stays in flight until it
+// is accepted or released. Returns ErrQueueEmpty if there is none.
+func (c *Client) Peek(ctx context.Context, queue string) (proto.QueuicItem, error) {
+	resp, err := c.request(ctx, proto.PEEK, queue, proto.QueuicItem{}, nil, proto.PEEK_ACK)
+	if err != nil {
+		return proto.QueuicItem{}, err
+	}
+	return resp.QueuicItem, nil
+}
+
+// PeekBatch returns up to max items, the server may return less
+// so that the response fits in a single packet.
+func (c *Client) PeekBatch(ctx context.Context, queue string, max int) ([]proto.QueuicItem, error) {
+	if max <= 0 || max > proto.MAX_BATCH_SIZE {
+		return nil, fmt.Errorf("%w: max must be between 1 and %d", ErrBadRequest, proto.MAX_BATCH_SIZE)
+	}
+	count := make([]byte, 2)
+	binary.LittleEndian.PutUint16(count, uint16(max))
+	resp, err := c.request(ctx, proto.PEEK_BATCH, queue, proto.QueuicItem{Item: count}, nil, proto.PEEK_BATCH_ACK)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Items, nil
+}
+
+func (c *Client) Accept(ctx context.Context, queue string, id uuid.UUID) error {
+	_, err := c.request(ctx, proto.ACCEPT, queue, proto.QueuicItem{Id: id}, nil, proto.ACCEPT_ACK)
+	return err
+}
+
+func (c *Client) AcceptBatch(ctx context.Context, queue string, ids []uuid.UUID) error {
+	_, err := c.request(ctx, proto.ACCEPT_BATCH, queue, proto.QueuicItem{}, idItems(ids), proto.ACCEPT_BATCH_ACK)
+	return err
+}
+
+func (c *Client) Release(ctx context.Context, queue string, id uuid.UUID) error {
+	_, err := c.request(ctx, proto.RELEASE, queue, proto.QueuicItem{Id: id}, nil, proto.RELEASE_ACK)
+	return err
+}
+
+func (c *Client) ReleaseBatch(ctx context.Context, queue string, ids []uuid.UUID) error {
+	_, err := c.request(ctx, proto.RELEASE_BATCH, queue, proto.QueuicItem{}, idItems(ids), proto.RELEASE_BATCH_ACK)
+	return err
+}
+
+// Size returns the count of items including the ones in flight
+func (c *Client) Size(ctx context.Context, queue string) (int, error) {
+	resp, err := c.request(ctx, proto.SIZE, queue, proto.QueuicItem{}, nil, proto.SIZE_ACK)
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.QueuicItem.Item) < 8 {
+		return 0, fmt.Errorf("invalid size response")
+	}
+	return int(binary.LittleEndian.Uint64(resp.QueuicItem.Item)), nil
+}
+
+func (c *Client) CreateQueue(ctx context.Context, queue string) error {
+	_, err := c.request(ctx, proto.CREATE_QUEUE, queue, proto.QueuicItem{}, nil, proto.CREATE_QUEUE_ACK)
+	return err
+}
+
+func (c *Client) DeleteQueue(ctx context.Context, queue string) error {
+	_, err := c.request(ctx, proto.DELETE_QUEUE, queue, proto.QueuicItem{}, nil, proto.DELETE_QUEUE_ACK)
+	return err
+}
+
+func (c *Client) ListQueues(ctx context.Context) ([]string, error) {
+	names := make([]string, 0)
+	// the names are sent in pages which fit in a packet
+	for {
+		resp, err := c.request(ctx, proto.LIST_QUEUES, "", pageItem(len(names)), nil, proto.LIST_QUEUES_ACK)
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Items) == 0 {
+			return names, nil
+		}
+		for _, item := range resp.Items {
+			names = append(names, string(item.Item))
+		}
+	}
+}
+
+// Stats returns the stats of the queue, or of all queues if queue is empty
+func (c *Client) Stats(ctx context.Context, queue string) ([]server.QueueStats, error) {
+	stats := make([]server.QueueStats, 0)
+	for {
+		resp, err := c.request(ctx, proto.STATS, queue, pageItem(len(stats)), nil, proto.STATS_ACK)
+		if err != nil {
+			return nil, err
+		}
+		var page []server.QueueStats
+		if err := json.Unmarshal(resp.QueuicItem.Item, &page); err != nil {
+			return nil, fmt.Errorf("invalid stats response: %w", err)
+		}
+		stats = append(stats, page...)
+		// the stats of all queues are sent in pages which fit in a packet
+		if queue != "" || len(page) == 0 {
+			return stats, nil
+		}
+	}
+}
+
+// pageItem is the item of a paged request which starts at offset
+func pageItem(offset int) proto.QueuicItem {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(offset))
+	return proto.QueuicItem{Item: b}
+}
+
+// Purge removes all items which are not in flight, with inFlight
+// also the in flight ones, and returns their count
+func (c *Client) Purge(ctx context.Context, queue string, inFlight bool) (int, error) {
+	item := proto.QueuicItem{}
+	if inFlight {
+		item.Item = []byte{1}
+	}
+	resp, err := c.request(ctx, proto.PURGE, queue, item, nil, proto.PURGE_ACK)
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.QueuicItem.Item) < 8 {
+		return 0, fmt.Errorf("invalid purge response")
+	}
+	return int(binary.LittleEndian.Uint64(resp.QueuicItem.Item)), nil
+}
+
+// Move moves the waiting items of source which match the filter to
+// destination and returns their count
+func (c *Client) Move(ctx context.Context, source string, destination string, filter server.MoveFilter) (int, error) {
+	b, err := json.Marshal(server.MoveRequest{Destination: proto.QueueName(destination), MoveFilter: filter})
+	if err != nil {
+		return 0, err
+	}
+	resp, err := c.request(ctx, proto.MOVE, source, proto.QueuicItem{Item: b}, nil, proto.MOVE_ACK)
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.QueuicItem.Item) < 8 {
+		return 0, fmt.Errorf("invalid move response")
+	}
+	return int(binary.LittleEndian.Uint64(resp.QueuicItem.Item)), nil
+}
+
+// Browse lists up to limit items starting at offset without peeking them.
+// The server may return less items than limit to fit in a packet.
+func (c *Client) Browse(ctx context.Context, queue string, offset int, limit int) (server.BrowsePage, error) {
+	if offset < 0 || uint64(offset) > math.MaxUint32 || limit <= 0 || limit > server.MAX_BROWSE_LIMIT {
+		return server.BrowsePage{}, fmt.Errorf("%w: offset must not be negative and limit must be between 1 and %d", ErrBadRequest, server.MAX_BROWSE_LIMIT)
+	}
+	b := make([]byte, 6)
+	binary.LittleEndian.PutUint32(b, uint32(offset))
+	binary.LittleEndian.PutUint16(b[4:], uint16(limit))
+	resp, err := c.request(ctx, proto.BROWSE, queue, proto.QueuicItem{Item: b}, nil, proto.BROWSE_ACK)
+	if err != nil {
+		return server.BrowsePage{}, err
+	}
+	var page server.BrowsePage
+	if err := json.Unmarshal(resp.QueuicItem.Item, &page); err != nil {
+		return server.BrowsePage{}, fmt.Errorf("invalid browse response: %w", err)
+	}
+	return page, nil
+}
+
+func (c *Client) request(ctx context.Context, cmd proto.Command, queue string, item proto.QueuicItem, items []proto.QueuicItem, expected proto.Command) (*proto.Queuic, error) {
+	name := proto.QueueName(queue)
+	if queue != "" {
+		if err := name.Validate(); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadRequest, err)
+		}
+	}
+	// the trace context of ctx lets the server spans join the trace,
+	// an enqueued item keeps it for its consumer
+	if !cmd.IsBatch() {
+		item.Headers = trace.Inject(ctx, item.Headers)
+	}
+	// the request id is the same for the retransmits of this request,
+	// so only they are answered from the response cache of the server
+	req := proto.Queuic{
+		Command:    cmd,
+		RequestId:  uuid.New(),
+		QueueName:  name,
+		QueuicItem: item,
+		Items:      items,
+	}
+	b, err := proto.Encode(&req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+	encrypted, err := proto.Encrypt(c.key[:], b)
+	if err != nil {
+		return nil, err
+	}
+	if len(encrypted) > server.MAX_PACKET_LENGTH {
+		return nil, fmt.Errorf("%w: request of %d bytes exceeds max packet length", ErrBadRequest, len(encrypted))
+	}
+	resp, err := c.roundTrip(ctx, encrypted, name, expected)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Command == proto.ERROR {
+		code, message := proto.DecodeError(resp.QueuicItem.Item)
+		return nil, &ServerError{Code: code, Message: message}
+	}
+	return resp, nil
+}
+
+// roundTrip uses a new socket for every request, so responses
+// to an earlier request can not be mistaken for this one
+func (c *Client) roundTrip(ctx context.Context, packet []byte, name proto.QueueName, expected proto.Command) (*proto.Queuic, error) {
+	conn, err := net.DialUDP(server.NETWORK_TYPE, nil, c.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s: %w", c.addr, err)
+	}
+	defer conn.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// unblock the read
+			conn.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	buff := make([]byte, server.MAX_PACKET_LENGTH)
+	for attempt := 0; attempt <= c.Retries; attempt++ {
+		if attempt > 0 {
+			atomic.AddUint64(&c.retransmits, 1)
+		}
+		if _, err := conn.Write(packet); err != nil {
+			return nil, fmt.Errorf("failed to send request: %w", err)
+		}
+		deadline := time.Now().Add(c.Timeout)
+		ctxDeadline := false
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline, ctxDeadline = d, true
+		}
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+		for {
+			n, err := conn.Read(buff)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				if ctxDeadline {
+					return nil, context.DeadlineExceeded
+				}
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to read response: %w", err)
+			}
+			decrypted, err := proto.Decrypt(c.key[:], buff[:n])
+			if err != nil {
+				continue
+			}
+			resp, err := proto.Decode(decrypted)
+			if err != nil {
+				continue
+			}
+			if resp.QueueName != name || (resp.Command != expected && resp.Command != proto.ERROR) {
+				continue
+			}
+			return resp, nil
+		}
+	}
+	atomic.AddUint64(&c.timeouts, 1)
+	return nil, ErrTimeout
+}
+
+// Retransmits returns how many requests were sent again
+// because their response did not arrive in time
+func (c *Client) Retransmits() uint64 {
+	return atomic.LoadUint64(&c.retransmits)
+}
+
+// Timeouts returns how many requests failed with ErrTimeout
+func (c *Client) Timeouts() uint64 {
+	return atomic.LoadUint64(&c.timeouts)
+}
+
+func idItems(ids []uuid.UUID) []proto.QueuicItem {
+	items := make([]proto.QueuicItem, len(ids))
+	for i, id := range ids {
+		items[i] = proto.QueuicItem{Id: id}
+	}
+	return items
+}
@@ -0,0 +1,251 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dinifarb/queuic/pkg/client"
+	"github.com/dinifarb/queuic/pkg/proto"
+	"github.com/dinifarb/queuic/pkg/server"
+	"github.com/google/uuid"
+)
+
+const testPort = 9531
+
+var testServer *server.QueuicServer
+
+func TestMain(m *testing.M) {
+	os.RemoveAll("./data")
+	testServer = server.NewQueuicServer("test")
+	testServer.Port = testPort
+	go testServer.Serve()
+	// give the server time to bind the port
+	time.Sleep(100 * time.Millisecond)
+	os.Exit(m.Run())
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	c, err := client.New("localhost:9531", "test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := c.CreateQueue(ctx, "client"); err != nil {
+		t.Fatalf("failed to create queue: %v", err)
+	}
+	if err := c.CreateQueue(ctx, "client"); !errors.Is(err, client.ErrQueueExists) {
+		t.Errorf("expected ErrQueueExists, got %v", err)
+	}
+	if _, err := c.Peek(ctx, "client"); !errors.Is(err, client.ErrQueueEmpty) {
+		t.Errorf("expected ErrQueueEmpty, got %v", err)
+	}
+	if _, err := c.Size(ctx, "missing"); !errors.Is(err, client.ErrQueueNotFound) {
+		t.Errorf("expected ErrQueueNotFound, got %v", err)
+	}
+	id, err := c.Enqueue(ctx, "client", []byte("single"), map[string]string{"source": "test"})
+	if err != nil {
+		t.Errorf("failed to enqueue: %v", err)
+	}
+	err = c.EnqueueBatch(ctx, "client", []proto.QueuicItem{{Item: []byte("first")}, {Item: []byte("second")}})
+	if err != nil {
+		t.Errorf("failed to enqueue batch: %v", err)
+	}
+	item, err := c.Peek(ctx, "client")
+	if err != nil {
+		t.Errorf("failed to peek: %v", err)
+	}
+	if item.Id != id || item.Headers["source"] != "test" {
+		t.Errorf("unexpected item: %+v", item)
+	}
+	if err := c.Release(ctx, "client", item.Id); err != nil {
+		t.Errorf("failed to release: %v", err)
+	}
+	items, err := c.PeekBatch(ctx, "client", 10)
+	if err != nil {
+		t.Errorf("failed to peek batch: %v", err)
+	}
+	if len(items) != 3 || items[0].Id != id {
+		t.Errorf("unexpected items: %+v", items)
+	}
+	page, err := c.Browse(ctx, "client", 1, 10)
+	if err != nil || page.Total != 3 || len(page.Items) != 2 || !page.Items[0].InFlight {
+		t.Errorf("unexpected page: %+v, %v", page, err)
+	}
+	if err := c.AcceptBatch(ctx, "client", []uuid.UUID{items[0].Id, items[1].Id}); err != nil {
+		t.Errorf("failed to accept batch: %v", err)
+	}
+	if err := c.Accept(ctx, "client", items[2].Id); err != nil {
+		t.Errorf("failed to accept: %v", err)
+	}
+	if size, err := c.Size(ctx, "client"); err != nil || size != 0 {
+		t.Errorf("expected size 0, got %d, %v", size, err)
+	}
+	stats, err := c.Stats(ctx, "client")
+	if err != nil || len(stats) != 1 || stats[0].Dequeued != 3 {
+		t.Errorf("unexpected stats: %+v, %v", stats, err)
+	}
+	names, err := c.ListQueues(ctx)
+	if err != nil || len(names) == 0 || names[0] != "client" {
+		t.Errorf("unexpected queues: %v, %v", names, err)
+	}
+	if err := c.DeleteQueue(ctx, "client"); err != nil {
+		t.Errorf("failed to delete queue: %v", err)
+	}
+	if _, err := c.Enqueue(ctx, "../client", nil, nil); !errors.Is(err, client.ErrBadRequest) {
+		t.Errorf("expected ErrBadRequest, got %v", err)
+	}
+}
+
+func TestReleaseTwice(t *testing.T) {
+	ctx := context.Background()
+	c, err := client.New("localhost:9531", "test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := c.CreateQueue(ctx, "release"); err != nil {
+		t.Fatalf("failed to create queue: %v", err)
+	}
+	defer c.DeleteQueue(ctx, "release")
+	id, _ := c.Enqueue(ctx, "release", []byte("retried"), nil)
+	// a handler which fails twice releases the same item twice
+	for i := 0; i < 2; i++ {
+		item, err := c.Peek(ctx, "release")
+		if err != nil || item.Id != id {
+			t.Fatalf("peek %d: unexpected item %+v: %v", i, item, err)
+		}
+		if err := c.Release(ctx, "release", id); err != nil {
+			t.Fatalf("release %d failed: %v", i, err)
+		}
+	}
+	page, err := c.Browse(ctx, "release", 0, 10)
+	if err != nil || len(page.Items) != 1 || page.Items[0].InFlight {
+		t.Errorf("expected the released item to wait, got %+v: %v", page, err)
+	}
+	if _, err := c.Peek(ctx, "release"); err != nil {
+		t.Errorf("failed to peek the released item: %v", err)
+	}
+}
+
+func TestManyQueues(t *testing.T) {
+	ctx := context.Background()
+	c, err := client.New("localhost:9531", "test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	// the names and stats of 60 long queue names do not fit in a packet
+	created := make(map[string]bool)
+	for i := 0; i < 60; i++ {
+		name := fmt.Sprintf("many-%02d-%s", i, strings.Repeat("q", proto.MAX_QUEUE_NAME_LENGTH-8))
+		if err := testServer.CreateQueue(proto.QueueName(name)); err != nil {
+			t.Fatalf("failed to create queue: %v", err)
+		}
+		defer testServer.DeleteQueue(proto.QueueName(name))
+		created[name] = true
+	}
+	names, err := c.ListQueues(ctx)
+	if err != nil {
+		t.Fatalf("failed to list queues: %v", err)
+	}
+	found := 0
+	for _, name := range names {
+		if created[name] {
+			found++
+		}
+	}
+	if found != len(created) {
+		t.Errorf("expected %d queues, got %d of %d names", len(created), found, len(names))
+	}
+	stats, err := c.Stats(ctx, "")
+	if err != nil {
+		t.Fatalf("failed to get stats: %v", err)
+	}
+	found = 0
+	for _, s := range stats {
+		if created[s.QueueName] {
+			found++
+		}
+	}
+	if found != len(created) {
+		t.Errorf("expected stats of %d queues, got %d of %d", len(created), found, len(stats))
+	}
+}
+
+func TestClientRetransmit(t *testing.T) {
+	ctx := context.Background()
+	proxy := newLossyProxy(t, "localhost:9531")
+	defer proxy.Close()
+	c, err := client.New(proxy.LocalAddr().String(), "test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	c.Timeout = 200 * time.Millisecond
+	if err := c.CreateQueue(ctx, "retransmit"); err != nil {
+		t.Fatalf("failed to create queue: %v", err)
+	}
+	defer c.DeleteQueue(context.Background(), "retransmit")
+	if _, err := c.Enqueue(ctx, "retransmit", []byte("once"), nil); err != nil {
+		t.Errorf("failed to enqueue: %v", err)
+	}
+	if size, err := c.Size(ctx, "retransmit"); err != nil || size != 1 {
+		t.Errorf("expected size 1, got %d, %v", size, err)
+	}
+	c.Retries = 0
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Size(ctx, "retransmit"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context deadline, got %v", err)
+	}
+}
+
+// newLossyProxy forwards packets to the server but drops
+// every first response of a client address
+func newLossyProxy(t *testing.T, target string) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	targetAddr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	go func() {
+		upstreams := make(map[string]*net.UDPConn)
+		buff := make([]byte, server.MAX_PACKET_LENGTH)
+		for {
+			n, addr, err := conn.ReadFromUDP(buff)
+			if err != nil {
+				return
+			}
+			upstream, ok := upstreams[addr.String()]
+			if !ok {
+				upstream, err = net.DialUDP("udp", nil, targetAddr)
+				if err != nil {
+					return
+				}
+				upstreams[addr.String()] = upstream
+				go func(addr *net.UDPAddr) {
+					defer upstream.Close()
+					resp := make([]byte, server.MAX_PACKET_LENGTH)
+					for dropped := false; ; dropped = true {
+						n, err := upstream.Read(resp)
+						if err != nil {
+							return
+						}
+						if dropped {
+							conn.WriteToUDP(resp[:n], addr)
+						}
+					}
+				}(addr)
+			}
+			upstream.Write(buff[:n])
+		}
+	}()
+	return conn
+}
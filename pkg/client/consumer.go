@@ -0,0 +1,153 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dinifarb/mlog"
+	"github.com/dinifarb/queuic/pkg/proto"
+	"github.com/dinifarb/queuic/pkg/trace"
+	"github.com/google/uuid"
+)
+
+const (
+	DEFAULT_WORKERS       = 1
+	DEFAULT_POLL_INTERVAL = 500 * time.Millisecond
+	DEFAULT_DRAIN_TIMEOUT = 30 * time.Second
+)
+
+// Handler processes a peeked item, the item is accepted if it returns
+// nil and released if it returns an error or panics.
+type Handler func(ctx context.Context, item proto.QueuicItem) error
+
+// Consumer runs Workers goroutines which peek items of Queue and
+// pass them to Handler.
+type Consumer struct {
+	Client  *Client
+	Queue   string
+	Handler Handler
+	Workers int
+	// PollInterval is the time to wait after the queue was empty
+	PollInterval time.Duration
+	// DrainTimeout is the time the handlers get to finish after the context
+	// of Run is done, after that the context of the handlers is canceled
+	DrainTimeout time.Duration
+	// MaxRetries and RetryBackoff retry the accept or release of
+	// an item while the server is busy
+	MaxRetries   int
+	RetryBackoff time.Duration
+}
+
+func NewConsumer(client *Client, queue string, handler Handler) *Consumer {
+	return &Consumer{
+		Client:       client,
+		Queue:        queue,
+		Handler:      handler,
+		Workers:      DEFAULT_WORKERS,
+		PollInterval: DEFAULT_POLL_INTERVAL,
+		DrainTimeout: DEFAULT_DRAIN_TIMEOUT,
+		MaxRetries:   DEFAULT_MAX_RETRIES,
+		RetryBackoff: DEFAULT_RETRY_BACKOFF,
+	}
+}
+
+// Run consumes until ctx is done, then it stops peeking and waits
+// for the running handlers to finish before it returns.
+func (c *Consumer) Run(ctx context.Context) error {
+	if c.Client == nil || c.Handler == nil {
+		return fmt.Errorf("consumer needs a client and a handler")
+	}
+	if c.Workers <= 0 {
+		return fmt.Errorf("consumer needs at least one worker")
+	}
+	// the handlers keep running after ctx is done until the drain timeout
+	handlerCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		select {
+		case <-time.After(c.DrainTimeout):
+			mlog.Warn("consumer of queue %s did not drain in %v", c.Queue, c.DrainTimeout)
+			cancel()
+		case <-handlerCtx.Done():
+		}
+	}()
+	wg := sync.WaitGroup{}
+	wg.Add(c.Workers)
+	for i := 0; i < c.Workers; i++ {
+		go func() {
+			defer wg.Done()
+			c.work(ctx, handlerCtx)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+func (c *Consumer) work(ctx context.Context, handlerCtx context.Context) {
+	for ctx.Err() == nil {
+		// a peek canceled with ctx could leave the item in flight
+		item, err := c.Client.Peek(handlerCtx, c.Queue)
+		if err != nil {
+			if handlerCtx.Err() != nil {
+				return
+			}
+			if !errors.Is(err, ErrQueueEmpty) {
+				mlog.Error("consumer failed to peek queue %s: %v", c.Queue, err)
+			}
+			c.wait(ctx)
+			continue
+		}
+		// accept and release must not be canceled with ctx,
+		// otherwise the item would stay in flight
+		if err := c.handle(handlerCtx, item); err != nil {
+			mlog.Warn("release item %v of queue %s: %v", item.Id, c.Queue, err)
+			if err := c.settle(c.Client.Release, item); err != nil {
+				mlog.Error("consumer failed to release item %v: %v", item.Id, err)
+			}
+			continue
+		}
+		if err := c.settle(c.Client.Accept, item); err != nil {
+			mlog.Error("consumer failed to accept item %v: %v", item.Id, err)
+		}
+	}
+}
+
+// settle accepts or releases the item, it is retried while the server
+// is busy because the item would stay in flight otherwise
+func (c *Consumer) settle(op func(context.Context, string, uuid.UUID) error, item proto.QueuicItem) error {
+	var err error
+	for attempt := 0; attempt <= c.MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(c.RetryBackoff * time.Duration(attempt))
+		}
+		err = op(context.Background(), c.Queue, item.Id)
+		if !errors.Is(err, ErrBusy) {
+			return err
+		}
+	}
+	return err
+}
+
+func (c *Consumer) handle(ctx context.Context, item proto.QueuicItem) (err error) {
+	// spans of the handler are children of the span which enqueued the item
+	if sc, ok := trace.Extract(item.Headers); ok {
+		ctx = trace.ContextWithSpanContext(ctx, sc)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler panicked: %v", r)
+		}
+	}()
+	return c.Handler(ctx, item)
+}
+
+func (c *Consumer) wait(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(c.PollInterval):
+	}
+}
@@ -0,0 +1,124 @@
+package client_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dinifarb/queuic/pkg/client"
+	"github.com/dinifarb/queuic/pkg/proto"
+	"github.com/dinifarb/queuic/pkg/server"
+	"github.com/google/uuid"
+)
+
+func TestConsumer(t *testing.T) {
+	ctx := context.Background()
+	c, err := client.New("localhost:9531", "test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := c.CreateQueue(ctx, "consumer"); err != nil {
+		t.Fatalf("failed to create queue: %v", err)
+	}
+	defer c.DeleteQueue(ctx, "consumer")
+	for i := 0; i < 20; i++ {
+		if _, err := c.Enqueue(ctx, "consumer", []byte(fmt.Sprint(i)), nil); err != nil {
+			t.Fatalf("failed to enqueue: %v", err)
+		}
+	}
+	var handled int32
+	failed := sync.Map{}
+	done := make(chan struct{})
+	consumer := client.NewConsumer(c, "consumer", func(ctx context.Context, item proto.QueuicItem) error {
+		// fail every item once, the odd ones with a panic
+		if _, ok := failed.LoadOrStore(item.Id, true); !ok {
+			if item.Item[len(item.Item)-1]%2 == 1 {
+				panic("odd item")
+			}
+			return fmt.Errorf("even item")
+		}
+		if atomic.AddInt32(&handled, 1) == 20 {
+			close(done)
+		}
+		return nil
+	})
+	consumer.Workers = 4
+	consumer.PollInterval = 10 * time.Millisecond
+	runCtx, cancel := context.WithCancel(ctx)
+	stopped := make(chan error)
+	go func() {
+		stopped <- consumer.Run(runCtx)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("consumer handled %d of 20 items", atomic.LoadInt32(&handled))
+	}
+	cancel()
+	if err := <-stopped; err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if size, err := c.Size(ctx, "consumer"); err != nil || size != 0 {
+		t.Errorf("expected size 0, got %d, %v", size, err)
+	}
+}
+
+func TestConsumerRetriesBusy(t *testing.T) {
+	os.Remove("./data/settle.queuic")
+	os.Remove("./data/flood.queuic")
+	defer os.Remove("./data/settle.queuic")
+	defer os.Remove("./data/flood.queuic")
+	svr := server.NewQueuicServer("test")
+	svr.Port = testPort + 1
+	svr.Workers = 1
+	svr.Backlog = 1
+	svr.CreateQueue("settle")
+	svr.CreateQueue("flood")
+	go svr.Serve()
+	defer svr.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+
+	ctx := context.Background()
+	c, err := client.New(fmt.Sprintf("localhost:%d", svr.Port), "test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := c.Enqueue(ctx, "settle", []byte("item"), nil); err != nil {
+		t.Fatalf("failed to enqueue: %v", err)
+	}
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: svr.Port})
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	key := sha256.Sum256([]byte("test"))
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	consumer := client.NewConsumer(c, "settle", func(ctx context.Context, item proto.QueuicItem) error {
+		// a burst of enqueues saturates the single worker, so the
+		// accept of the item is answered with ERR_BUSY at first
+		for i := 0; i < 200; i++ {
+			req, _ := proto.Encode(&proto.Queuic{Command: proto.ENQUEUE, QueueName: "flood", QueuicItem: proto.QueuicItem{Id: uuid.New(), Item: []byte("burst")}})
+			encrypted, _ := proto.Encrypt(key[:], req)
+			conn.Write(encrypted)
+		}
+		cancel()
+		return nil
+	})
+	consumer.PollInterval = 10 * time.Millisecond
+	if err := consumer.Run(runCtx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the rest of the burst is handled before the item is browsed
+	time.Sleep(100 * time.Millisecond)
+	page, err := c.Browse(ctx, "settle", 0, 10)
+	if err != nil || page.Total != 0 {
+		t.Errorf("expected the item to be accepted, got %+v, %v", page, err)
+	}
+}
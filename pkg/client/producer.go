@@ -0,0 +1,278 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dinifarb/queuic/pkg/proto"
+	"github.com/dinifarb/queuic/pkg/server"
+	"github.com/dinifarb/queuic/pkg/trace"
+	"github.com/google/uuid"
+)
+
+const (
+	DEFAULT_BATCH_SIZE    = 100
+	DEFAULT_LINGER        = 10 * time.Millisecond
+	DEFAULT_MAX_IN_FLIGHT = 1
+	DEFAULT_MAX_RETRIES   = 3
+	DEFAULT_RETRY_BACKOFF = 100 * time.Millisecond
+)
+
+var ErrProducerClosed = errors.New("producer is closed")
+
+// Future is the result of an item sent by a Producer
+type Future struct {
+	Id   uuid.UUID
+	done chan struct{}
+	err  error
+}
+
+// Done is closed once the item is enqueued or failed
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Err returns the error of the item, it is only valid after Done is closed
+func (f *Future) Err() error {
+	return f.err
+}
+
+// Wait waits until the item is enqueued or failed
+func (f *Future) Wait(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (f *Future) complete(err error) {
+	f.err = err
+	close(f.done)
+}
+
+type record struct {
+	item   proto.QueuicItem
+	future *Future
+}
+
+// Producer buffers the items of Send and enqueues them as batches
+// once BatchSize items are buffered or the first of them waited Linger.
+// Failed batches are retried with the same item ids, so the server drops
+// items it already enqueued.
+type Producer struct {
+	Client       *Client
+	Queue        string
+	BatchSize    int
+	Linger       time.Duration
+	MaxInFlight  int
+	MaxRetries   int
+	RetryBackoff time.Duration
+	startOnce    sync.Once
+	mu           sync.RWMutex
+	closed       bool
+	records      chan *record
+	flush        chan chan struct{}
+	done         chan struct{}
+}
+
+func NewProducer(client *Client, queue string) *Producer {
+	return &Producer{
+		Client:       client,
+		Queue:        queue,
+		BatchSize:    DEFAULT_BATCH_SIZE,
+		Linger:       DEFAULT_LINGER,
+		MaxInFlight:  DEFAULT_MAX_IN_FLIGHT,
+		MaxRetries:   DEFAULT_MAX_RETRIES,
+		RetryBackoff: DEFAULT_RETRY_BACKOFF,
+	}
+}
+
+// Send buffers the item and returns immediately
+func (p *Producer) Send(item []byte, headers map[string]string) *Future {
+	return p.SendContext(context.Background(), item, headers)
+}
+
+// SendContext is Send with the trace context of ctx added to the headers
+func (p *Producer) SendContext(ctx context.Context, item []byte, headers map[string]string) *Future {
+	headers = trace.Inject(ctx, headers)
+	if item == nil {
+		item = []byte{}
+	}
+	f := &Future{Id: uuid.New(), done: make(chan struct{})}
+	r := &record{
+		item:   proto.QueuicItem{Id: f.Id, Item: item, Headers: headers},
+		future: f,
+	}
+	if err := proto.ValidateHeaders(headers); err != nil {
+		f.complete(fmt.Errorf("%w: %v", ErrBadRequest, err))
+		return f
+	}
+	if proto.BatchItemLength(r.item) > server.MAX_BATCH_BYTES {
+		f.complete(fmt.Errorf("%w: item of %d bytes does not fit in a packet", ErrBadRequest, len(item)))
+		return f
+	}
+	p.start()
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		f.complete(ErrProducerClosed)
+		return f
+	}
+	p.records <- r
+	return f
+}
+
+// Flush sends all buffered items and waits until they are done
+func (p *Producer) Flush(ctx context.Context) error {
+	p.start()
+	p.mu.RLock()
+	if p.closed {
+		p.mu.RUnlock()
+		return ErrProducerClosed
+	}
+	ack := make(chan struct{})
+	p.flush <- ack
+	p.mu.RUnlock()
+	select {
+	case <-ack:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close sends all buffered items and waits until they are done,
+// Send fails with ErrProducerClosed afterwards.
+func (p *Producer) Close() error {
+	p.start()
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ErrProducerClosed
+	}
+	p.closed = true
+	close(p.records)
+	p.mu.Unlock()
+	<-p.done
+	return nil
+}
+
+func (p *Producer) start() {
+	p.startOnce.Do(func() {
+		if p.BatchSize <= 0 {
+			p.BatchSize = DEFAULT_BATCH_SIZE
+		}
+		if p.MaxInFlight <= 0 {
+			p.MaxInFlight = DEFAULT_MAX_IN_FLIGHT
+		}
+		p.records = make(chan *record, p.BatchSize)
+		p.flush = make(chan chan struct{})
+		p.done = make(chan struct{})
+		go p.run()
+	})
+}
+
+func (p *Producer) run() {
+	defer close(p.done)
+	inFlight := make(chan struct{}, p.MaxInFlight)
+	wg := sync.WaitGroup{}
+	batch := make([]*record, 0, p.BatchSize)
+	size := 0
+	var linger <-chan time.Time
+	send := func() {
+		linger = nil
+		if len(batch) == 0 {
+			return
+		}
+		records := batch
+		batch = make([]*record, 0, p.BatchSize)
+		size = 0
+		inFlight <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.send(records)
+			<-inFlight
+		}()
+	}
+	add := func(r *record) {
+		length := proto.BatchItemLength(r.item)
+		if size+length > server.MAX_BATCH_BYTES {
+			send()
+		}
+		if len(batch) == 0 {
+			linger = time.After(p.Linger)
+		}
+		batch = append(batch, r)
+		size += length
+		if len(batch) >= p.BatchSize {
+			send()
+		}
+	}
+	for {
+		select {
+		case r, ok := <-p.records:
+			if !ok {
+				send()
+				wg.Wait()
+				return
+			}
+			add(r)
+		case <-linger:
+			send()
+		case ack := <-p.flush:
+			// records sent before the flush may still be buffered in the channel
+		drain:
+			for {
+				select {
+				case r, ok := <-p.records:
+					if !ok {
+						break drain
+					}
+					add(r)
+				default:
+					break drain
+				}
+			}
+			send()
+			wg.Wait()
+			close(ack)
+		}
+	}
+}
+
+func (p *Producer) send(records []*record) {
+	items := make([]proto.QueuicItem, len(records))
+	for i, r := range records {
+		items[i] = r.item
+	}
+	var err error
+	for attempt := 0; attempt <= p.MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(p.RetryBackoff * time.Duration(attempt))
+		}
+		err = p.Client.EnqueueBatch(context.Background(), p.Queue, items)
+		if !retryable(err) {
+			break
+		}
+	}
+	for _, r := range records {
+		r.future.complete(err)
+	}
+}
+
+func retryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var serverErr *ServerError
+	if errors.As(err, &serverErr) {
+		return serverErr.Code == proto.ERR_INTERNAL || serverErr.Code == proto.ERR_QUEUE_FULL || serverErr.Code == proto.ERR_BUSY
+	}
+	return errors.Is(err, ErrTimeout)
+}
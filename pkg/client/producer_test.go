@@ -0,0 +1,113 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/dinifarb/queuic/pkg/client"
+	"github.com/dinifarb/queuic/pkg/queue"
+)
+
+func TestProducer(t *testing.T) {
+	ctx := context.Background()
+	c, err := client.New("localhost:9531", "test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := c.CreateQueue(ctx, "producer"); err != nil {
+		t.Fatalf("failed to create queue: %v", err)
+	}
+	defer c.DeleteQueue(ctx, "producer")
+	p := client.NewProducer(c, "producer")
+	p.BatchSize = 100
+	p.Linger = 20 * time.Millisecond
+	p.MaxInFlight = 2
+	// a few items are sent after the linger time
+	futures := make([]*client.Future, 0, 250)
+	for i := 0; i < 3; i++ {
+		futures = append(futures, p.Send([]byte(fmt.Sprint(i)), nil))
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	for _, f := range futures {
+		if err := f.Wait(waitCtx); err != nil {
+			t.Errorf("failed to send item: %v", err)
+		}
+	}
+	for i := 3; i < 250; i++ {
+		futures = append(futures, p.Send([]byte(fmt.Sprint(i)), map[string]string{"index": fmt.Sprint(i)}))
+	}
+	if err := p.Close(); err != nil {
+		t.Errorf("failed to close producer: %v", err)
+	}
+	for _, f := range futures {
+		select {
+		case <-f.Done():
+			if f.Err() != nil {
+				t.Errorf("failed to send item %v: %v", f.Id, f.Err())
+			}
+		default:
+			t.Errorf("item %v is not done after close", f.Id)
+		}
+	}
+	if size, err := c.Size(ctx, "producer"); err != nil || size != 250 {
+		t.Errorf("expected size 250, got %d, %v", size, err)
+	}
+	if err := p.Send([]byte("late"), nil).Wait(ctx); !errors.Is(err, client.ErrProducerClosed) {
+		t.Errorf("expected ErrProducerClosed, got %v", err)
+	}
+}
+
+func TestProducerQueueNotFound(t *testing.T) {
+	c, err := client.New("localhost:9531", "test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	p := client.NewProducer(c, "missing")
+	f := p.Send([]byte("lost"), nil)
+	if err := p.Flush(context.Background()); err != nil {
+		t.Errorf("failed to flush: %v", err)
+	}
+	if !errors.Is(f.Err(), client.ErrQueueNotFound) {
+		t.Errorf("expected ErrQueueNotFound, got %v", f.Err())
+	}
+	p.Close()
+}
+
+func TestProducerRetriesFullQueue(t *testing.T) {
+	ctx := context.Background()
+	c, err := client.New("localhost:9531", "test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := testServer.CreateQueueWithOptions("full", queue.Options{MaxLength: 1}); err != nil {
+		t.Fatalf("failed to create queue: %v", err)
+	}
+	defer c.DeleteQueue(ctx, "full")
+	c.Enqueue(ctx, "full", []byte("first"), nil)
+	p := client.NewProducer(c, "full")
+	p.Linger = time.Millisecond
+	p.RetryBackoff = 50 * time.Millisecond
+	p.MaxRetries = 5
+	defer p.Close()
+	f := p.Send([]byte("second"), nil)
+	// the first attempts fail with a full queue, a retry after the
+	// queue has room again must be handled and not answered from cache
+	time.Sleep(75 * time.Millisecond)
+	item, err := c.Peek(ctx, "full")
+	if err != nil {
+		t.Fatalf("failed to peek: %v", err)
+	}
+	c.Accept(ctx, "full", item.Id)
+	waitCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	if err := f.Wait(waitCtx); err != nil {
+		t.Errorf("retry after the queue has room failed: %v", err)
+	}
+	if size, err := c.Size(ctx, "full"); err != nil || size != 1 {
+		t.Errorf("expected size 1, got %d, %v", size, err)
+	}
+}
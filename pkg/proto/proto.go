@@ -1,16 +1,21 @@
 package proto
 
 import (
-	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"encoding/binary"
 	"fmt"
+	"sort"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 type Command uint8
-type QueueName [16]byte
+
+// QueueName is also used as file name by the queue,
+// so it is limited to letters, digits, '.', '_' and '-'
+type QueueName string
 
 const (
 	ENQUEUE Command = iota
@@ -23,79 +28,441 @@ const (
 	RELEASE_ACK
 	SIZE
 	SIZE_ACK
+	ENQUEUE_BATCH
+	ENQUEUE_BATCH_ACK
+	PEEK_BATCH
+	PEEK_BATCH_ACK
+	ACCEPT_BATCH
+	ACCEPT_BATCH_ACK
+	RELEASE_BATCH
+	RELEASE_BATCH_ACK
+	CREATE_QUEUE
+	CREATE_QUEUE_ACK
+	DELETE_QUEUE
+	DELETE_QUEUE_ACK
+	LIST_QUEUES
+	LIST_QUEUES_ACK
+	STATS
+	STATS_ACK
+	PURGE
+	PURGE_ACK
+	BROWSE
+	BROWSE_ACK
+	MOVE
+	MOVE_ACK
+	ERROR
+)
+
+// ErrorCode is the first byte of the item of an ERROR response,
+// followed by the error message
+type ErrorCode uint8
+
+const (
+	ERR_INTERNAL ErrorCode = iota
+	ERR_BAD_REQUEST
+	ERR_QUEUE_NOT_FOUND
+	ERR_QUEUE_EXISTS
+	ERR_QUEUE_EMPTY
+	ERR_QUEUE_FULL
+	// ERR_BUSY is returned when the server can't take more requests,
+	// the request was not handled and can be sent again later
+	ERR_BUSY
+	// ERR_ITEM_NOT_FOUND is returned when an accepted or released item is not in flight
+	ERR_ITEM_NOT_FOUND
 )
 
 const (
 	//	MAX_PACKET_LENGTH = 4096
-	MIN_PACKET_LENGTH = 17
+	MIN_PACKET_LENGTH     = 2
+	MAX_QUEUE_NAME_LENGTH = 64
+	// a command with this bit set is followed by a 16 byte request id
+	REQUEST_ID_FLAG   = 0x80
+	REQUEST_ID_LENGTH = 16
+	// command, request id, length of the queue name and the longest queue name
+	MAX_HEADER_LENGTH = 2 + REQUEST_ID_LENGTH + MAX_QUEUE_NAME_LENGTH
+	// every item in a batch is prefixed with its uuid,
+	// the count of its headers and a 4 byte length
+	BATCH_ITEM_OVERHEAD = 21
+	MAX_BATCH_SIZE      = 0xffff
+	MAX_HEADERS         = 0xff
+	MAX_HEADER_KEY      = 0xff
+	MAX_HEADER_VALUE    = 0xffff
 )
 
 type Queuic struct {
-	Command   Command
+	Command Command
+	// RequestId identifies a request, so the server answers a request
+	// which is sent again from its response cache. It is optional,
+	// requests without one are always handled.
+	RequestId uuid.UUID
 	QueueName QueueName
 	QueuicItem
+	// Items is only used by the batch commands
+	Items []QueuicItem
 }
 
 type QueuicItem struct {
 	Id   uuid.UUID
 	Item []byte
+	// Headers are key value attributes like content-type or trace id
+	Headers map[string]string
+	// Timestamp is set by the queue on enqueue and is not part of the packet
+	Timestamp time.Time
+}
+
+// IsBatch reports whether the command carries a list of items
+// instead of a single one. PEEK_BATCH is not a batch on the wire,
+// it carries the max count of items to peek in its item.
+func (c Command) IsBatch() bool {
+	switch c {
+	case ENQUEUE_BATCH, PEEK_BATCH_ACK, ACCEPT_BATCH, RELEASE_BATCH, LIST_QUEUES_ACK:
+		return true
+	default:
+		return false
+	}
+}
+
+var commandNames = []string{
+	"ENQUEUE", "ENQUEUE_ACK", "PEEK", "PEEK_ACK", "ACCEPT", "ACCEPT_ACK",
+	"RELEASE", "RELEASE_ACK", "SIZE", "SIZE_ACK", "ENQUEUE_BATCH", "ENQUEUE_BATCH_ACK",
+	"PEEK_BATCH", "PEEK_BATCH_ACK", "ACCEPT_BATCH", "ACCEPT_BATCH_ACK",
+	"RELEASE_BATCH", "RELEASE_BATCH_ACK", "CREATE_QUEUE", "CREATE_QUEUE_ACK",
+	"DELETE_QUEUE", "DELETE_QUEUE_ACK", "LIST_QUEUES", "LIST_QUEUES_ACK",
+	"STATS", "STATS_ACK", "PURGE", "PURGE_ACK", "BROWSE", "BROWSE_ACK",
+	"MOVE", "MOVE_ACK", "ERROR",
+}
+
+func (c Command) String() string {
+	if int(c) < len(commandNames) {
+		return commandNames[c]
+	}
+	return fmt.Sprintf("UNKNOWN_%d", c)
+}
+
+// BatchItemLength returns the number of bytes the item needs in a batch
+func BatchItemLength(item QueuicItem) int {
+	return BATCH_ITEM_OVERHEAD + headersLength(item.Headers) + len(item.Item)
+}
+
+// headersLength returns the bytes of the headers without their count
+func headersLength(headers map[string]string) int {
+	length := 0
+	for k, v := range headers {
+		length += 3 + len(k) + len(v)
+	}
+	return length
+}
+
+// ValidateHeaders checks that the headers fit in a packet
+func ValidateHeaders(headers map[string]string) error {
+	if len(headers) > MAX_HEADERS {
+		return fmt.Errorf("item has %d headers but max is %d", len(headers), MAX_HEADERS)
+	}
+	for k, v := range headers {
+		if len(k) == 0 || len(k) > MAX_HEADER_KEY {
+			return fmt.Errorf("header key %q must have 1 to %d bytes", k, MAX_HEADER_KEY)
+		}
+		if len(v) > MAX_HEADER_VALUE {
+			return fmt.Errorf("value of header %q is too long, max is %d bytes", k, MAX_HEADER_VALUE)
+		}
+	}
+	return nil
+}
+
+// encodeHeaders writes the count of headers followed by every header
+// as uint8 key length, key, uint16 value length and value
+func encodeHeaders(b []byte, headers map[string]string) int {
+	b[0] = byte(len(headers))
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	offset := 1
+	for _, k := range keys {
+		v := headers[k]
+		b[offset] = byte(len(k))
+		offset++
+		offset += copy(b[offset:], k)
+		binary.LittleEndian.PutUint16(b[offset:offset+2], uint16(len(v)))
+		offset += 2
+		offset += copy(b[offset:], v)
+	}
+	return offset
+}
+
+// decodeHeaders returns the headers and the count of bytes read
+func decodeHeaders(data []byte) (map[string]string, int, error) {
+	if len(data) < 1 {
+		return nil, 0, fmt.Errorf("item is missing header count")
+	}
+	count := int(data[0])
+	if count == 0 {
+		return nil, 1, nil
+	}
+	headers := make(map[string]string, count)
+	offset := 1
+	for i := 0; i < count; i++ {
+		if len(data) < offset+1 {
+			return nil, 0, fmt.Errorf("header %d is truncated", i)
+		}
+		keyLength := int(data[offset])
+		offset++
+		if len(data) < offset+keyLength+2 {
+			return nil, 0, fmt.Errorf("header %d is truncated", i)
+		}
+		k := string(data[offset : offset+keyLength])
+		offset += keyLength
+		valueLength := int(binary.LittleEndian.Uint16(data[offset : offset+2]))
+		offset += 2
+		if len(data) < offset+valueLength {
+			return nil, 0, fmt.Errorf("header %s is truncated", k)
+		}
+		headers[k] = string(data[offset : offset+valueLength])
+		offset += valueLength
+	}
+	return headers, offset, nil
 }
 
-func (q *QueueName) String() string {
-	b := q[:]
-	b = bytes.Trim(b, "\x00")
-	return string(b[:])
+func EncodeError(code ErrorCode, message string) []byte {
+	return append([]byte{byte(code)}, message...)
+}
+
+func DecodeError(item []byte) (ErrorCode, string) {
+	if len(item) == 0 {
+		return ERR_INTERNAL, "unknown error"
+	}
+	return ErrorCode(item[0]), string(item[1:])
+}
+
+func NewQueueName(s string) (QueueName, error) {
+	name := QueueName(s)
+	if err := name.Validate(); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+func (q QueueName) String() string {
+	return string(q)
 }
 
 func (q *QueueName) ParseFromString(s string) error {
-	b := []byte(s)
-	b = bytes.Trim(b, "\x00")
-	n := copy(q[:], b[:16])
-	if n < 16 {
-		return fmt.Errorf("string %v to long", s)
+	name, err := NewQueueName(s)
+	if err != nil {
+		return err
+	}
+	*q = name
+	return nil
+}
+
+func (q QueueName) Validate() error {
+	if len(q) == 0 {
+		return fmt.Errorf("queue name must not be empty")
+	}
+	if len(q) > MAX_QUEUE_NAME_LENGTH {
+		return fmt.Errorf("queue name %q is too long, it has %d characters but max is %d", string(q), len(q), MAX_QUEUE_NAME_LENGTH)
+	}
+	if q[0] == '.' {
+		return fmt.Errorf("queue name %q must not start with '.'", string(q))
+	}
+	for _, c := range []byte(q) {
+		if !isQueueNameChar(c) {
+			return fmt.Errorf("queue name %q contains invalid character %q, allowed are letters, digits, '.', '_' and '-'", string(q), c)
+		}
 	}
 	return nil
 }
 
+func isQueueNameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' ||
+		c >= 'A' && c <= 'Z' ||
+		c >= '0' && c <= '9' ||
+		c == '.' || c == '_' || c == '-'
+}
+
+func headerLength(q *Queuic) int {
+	if q.RequestId != uuid.Nil {
+		return 2 + REQUEST_ID_LENGTH + len(q.QueueName)
+	}
+	return 2 + len(q.QueueName)
+}
+
+func encodeHeader(b []byte, q *Queuic) {
+	b[0] = byte(q.Command)
+	if q.RequestId != uuid.Nil {
+		b[0] |= REQUEST_ID_FLAG
+		b = b[copy(b[1:], q.RequestId[:]):]
+	}
+	b[1] = byte(len(q.QueueName))
+	copy(b[2:], q.QueueName)
+}
+
+// PacketCommand returns the command of an encoded packet
+func PacketCommand(packet []byte) Command {
+	if len(packet) == 0 {
+		return ERROR
+	}
+	return Command(packet[0] &^ REQUEST_ID_FLAG)
+}
+
+// decodeHeader decodes the command, request id and queue name into
+// q and returns the offset of the payload
+func decodeHeader(data []byte, q *Queuic) (int, error) {
+	if len(data) < MIN_PACKET_LENGTH {
+		return 0, fmt.Errorf("packet is too short")
+	}
+	q.Command = PacketCommand(data)
+	start := 1
+	if data[0]&REQUEST_ID_FLAG != 0 {
+		if len(data) < MIN_PACKET_LENGTH+REQUEST_ID_LENGTH {
+			return 0, fmt.Errorf("packet is too short for request id")
+		}
+		copy(q.RequestId[:], data[1:1+REQUEST_ID_LENGTH])
+		start += REQUEST_ID_LENGTH
+	}
+	offset := start + 1 + int(data[start])
+	if len(data) < offset {
+		return 0, fmt.Errorf("packet is too short for queue name of length %d", data[start])
+	}
+	q.QueueName = QueueName(data[start+1 : offset])
+	if q.QueueName == "" {
+		return offset, nil
+	}
+	if err := q.QueueName.Validate(); err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
 func Encode(q *Queuic) ([]byte, error) {
-	length := MIN_PACKET_LENGTH
-	if q.QueuicItem.Item != nil {
+	if len(q.QueueName) > MAX_QUEUE_NAME_LENGTH {
+		return nil, fmt.Errorf("queue name %q is too long, max is %d characters", string(q.QueueName), MAX_QUEUE_NAME_LENGTH)
+	}
+	if q.Command.IsBatch() {
+		return encodeBatch(q)
+	}
+	header := headerLength(q)
+	length := header
+	hasItem := q.QueuicItem.Item != nil || q.QueuicItem.Id != uuid.Nil
+	if hasItem {
+		if err := ValidateHeaders(q.QueuicItem.Headers); err != nil {
+			return nil, err
+		}
 		length += len(q.QueuicItem.Id)
+		length += 1 + headersLength(q.QueuicItem.Headers)
 		length += len(q.QueuicItem.Item)
 	}
 	b := make([]byte, length)
-	b[0] = byte(q.Command)
-	copy(b[1:17], q.QueueName[:])
-	if q.QueuicItem.Item == nil {
+	encodeHeader(b, q)
+	if !hasItem {
 		return b, nil
 	} else {
-		copy(b[17:33], q.QueuicItem.Id[:])
-		copy(b[33:], q.QueuicItem.Item[:])
+		copy(b[header:header+16], q.QueuicItem.Id[:])
+		offset := header + 16
+		offset += encodeHeaders(b[offset:], q.QueuicItem.Headers)
+		copy(b[offset:], q.QueuicItem.Item[:])
 		return b, nil
 	}
 }
 
 func Decode(data []byte) (*Queuic, error) {
-	if len(data) < MIN_PACKET_LENGTH {
-		return nil, fmt.Errorf("packet is too short")
+	var q Queuic
+	offset, err := decodeHeader(data, &q)
+	if err != nil {
+		return nil, err
 	}
 	/* 	if len(data) > MAX_PACKET_LENGTH {
 		return nil, fmt.Errorf("packet is too long")
 	} */
-	var q Queuic
-	q.Command = Command(data[0])
-	copy(q.QueueName[:], data[1:17])
-	if len(data) > MIN_PACKET_LENGTH {
-		itemId, err := uuid.FromBytes(data[17:33])
+	if q.Command.IsBatch() {
+		items, err := decodeBatch(data[offset:])
+		if err != nil {
+			return nil, err
+		}
+		q.Items = items
+		return &q, nil
+	}
+	if len(data) > offset {
+		if len(data) < offset+16 {
+			return nil, fmt.Errorf("packet is too short for item uuid")
+		}
+		itemId, err := uuid.FromBytes(data[offset : offset+16])
 		if err != nil {
 			return nil, fmt.Errorf("failed to decode uuid: %v", err)
 		}
 		q.QueuicItem.Id = itemId
-		q.QueuicItem.Item = data[33:]
+		headers, n, err := decodeHeaders(data[offset+16:])
+		if err != nil {
+			return nil, err
+		}
+		q.QueuicItem.Headers = headers
+		q.QueuicItem.Item = data[offset+16+n:]
 	}
 	return &q, nil
 }
 
+func encodeBatch(q *Queuic) ([]byte, error) {
+	if len(q.Items) > MAX_BATCH_SIZE {
+		return nil, fmt.Errorf("batch of %d items exceeds max of %d", len(q.Items), MAX_BATCH_SIZE)
+	}
+	header := headerLength(q)
+	length := header + 2
+	for _, item := range q.Items {
+		if err := ValidateHeaders(item.Headers); err != nil {
+			return nil, err
+		}
+		length += BatchItemLength(item)
+	}
+	b := make([]byte, length)
+	encodeHeader(b, q)
+	binary.LittleEndian.PutUint16(b[header:header+2], uint16(len(q.Items)))
+	offset := header + 2
+	for _, item := range q.Items {
+		copy(b[offset:offset+16], item.Id[:])
+		offset += 16
+		offset += encodeHeaders(b[offset:], item.Headers)
+		binary.LittleEndian.PutUint32(b[offset:offset+4], uint32(len(item.Item)))
+		offset += 4
+		offset += copy(b[offset:], item.Item)
+	}
+	return b, nil
+}
+
+func decodeBatch(data []byte) ([]QueuicItem, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("batch is missing item count")
+	}
+	count := int(binary.LittleEndian.Uint16(data[:2]))
+	data = data[2:]
+	items := make([]QueuicItem, 0, count)
+	for i := 0; i < count; i++ {
+		if len(data) < BATCH_ITEM_OVERHEAD {
+			return nil, fmt.Errorf("batch item %d is too short", i)
+		}
+		itemId, err := uuid.FromBytes(data[:16])
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode uuid of batch item %d: %v", i, err)
+		}
+		headers, n, err := decodeHeaders(data[16:])
+		if err != nil {
+			return nil, fmt.Errorf("batch item %d: %v", i, err)
+		}
+		data = data[16+n:]
+		if len(data) < 4 {
+			return nil, fmt.Errorf("batch item %d is too short", i)
+		}
+		length := int(binary.LittleEndian.Uint32(data[:4]))
+		data = data[4:]
+		if len(data) < length {
+			return nil, fmt.Errorf("batch item %d is truncated", i)
+		}
+		items = append(items, QueuicItem{Id: itemId, Headers: headers, Item: data[:length]})
+		data = data[length:]
+	}
+	return items, nil
+}
+
 func Encrypt(key []byte, message []byte) ([]byte, error) {
 	if len(key) != 32 {
 		return nil, fmt.Errorf("key must be 32 bytes long")
@@ -126,6 +493,9 @@ func Decrypt(key []byte, encryptedMessage []byte) ([]byte, error) {
 		return nil, fmt.Errorf("failed to create new gcm: %v", err)
 	}
 	nonceSize := gcm.NonceSize()
+	if len(encryptedMessage) < nonceSize+gcm.Overhead() {
+		return nil, fmt.Errorf("encrypted message is too short")
+	}
 	nonce, ciphertext := encryptedMessage[:nonceSize], encryptedMessage[nonceSize:]
 	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
 	if err != nil {
@@ -2,6 +2,9 @@ package proto_test
 
 import (
 	"crypto/sha256"
+	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/dinifarb/queuic/pkg/proto"
@@ -9,8 +12,7 @@ import (
 )
 
 func TestEnDecode(t *testing.T) {
-	queueName := proto.QueueName{}
-	copy(queueName[:], []byte("test"))
+	queueName := proto.QueueName("test")
 	q := proto.Queuic{
 		Command:   proto.ENQUEUE,
 		QueueName: queueName,
@@ -38,9 +40,31 @@ func TestEnDecode(t *testing.T) {
 	}
 }
 
+func TestEnDecodeRequestId(t *testing.T) {
+	for _, q := range []proto.Queuic{
+		{Command: proto.RELEASE, RequestId: uuid.New(), QueueName: "test", QueuicItem: proto.QueuicItem{Id: uuid.New()}},
+		{Command: proto.ACCEPT_BATCH, RequestId: uuid.New(), QueueName: "test", Items: []proto.QueuicItem{{Id: uuid.New()}}},
+		{Command: proto.LIST_QUEUES, RequestId: uuid.New()},
+	} {
+		b, err := proto.Encode(&q)
+		if err != nil {
+			t.Fatalf("failed to encode %v: %v", q.Command, err)
+		}
+		if proto.PacketCommand(b) != q.Command {
+			t.Errorf("expected packet command %v, got %v", q.Command, proto.PacketCommand(b))
+		}
+		decoded, err := proto.Decode(b)
+		if err != nil {
+			t.Fatalf("failed to decode %v: %v", q.Command, err)
+		}
+		if decoded.Command != q.Command || decoded.RequestId != q.RequestId || decoded.QueueName != q.QueueName || len(decoded.Items) != len(q.Items) {
+			t.Errorf("expected %+v, got %+v", q, decoded)
+		}
+	}
+}
+
 func TestEnDecodeWithCrypto(t *testing.T) {
-	queueName := proto.QueueName{}
-	copy(queueName[:], []byte("test"))
+	queueName := proto.QueueName("test")
 	q := proto.Queuic{
 		Command:   proto.ENQUEUE,
 		QueueName: queueName,
@@ -77,3 +101,136 @@ func TestEnDecodeWithCrypto(t *testing.T) {
 		t.Errorf("unexpected value: %v", q2.QueuicItem.Item)
 	}
 }
+
+func TestEnDecodeBatch(t *testing.T) {
+	queueName := proto.QueueName("test")
+	q := proto.Queuic{
+		Command:   proto.ENQUEUE_BATCH,
+		QueueName: queueName,
+		Items: []proto.QueuicItem{
+			{Id: uuid.New(), Item: []byte("first")},
+			{Id: uuid.New(), Item: []byte{}},
+			{Id: uuid.New(), Item: []byte("third message")},
+		},
+	}
+	b, err := proto.Encode(&q)
+	if err != nil {
+		t.Errorf("failed to encode request: %v", err)
+	}
+	q2, err := proto.Decode(b)
+	if err != nil {
+		t.Errorf("failed to decode request: %v", err)
+		return
+	}
+	if q2.Command != proto.ENQUEUE_BATCH {
+		t.Errorf("unexpected command: %v", q2.Command)
+	}
+	if len(q2.Items) != len(q.Items) {
+		t.Errorf("expected %d items, got %d", len(q.Items), len(q2.Items))
+		return
+	}
+	for i, item := range q2.Items {
+		if item.Id != q.Items[i].Id {
+			t.Errorf("unexpected id at %d: %v", i, item.Id)
+		}
+		if string(item.Item) != string(q.Items[i].Item) {
+			t.Errorf("unexpected value at %d: %v", i, item.Item)
+		}
+	}
+	if _, err := proto.Decode(b[:len(b)-1]); err == nil {
+		t.Errorf("expected error for truncated batch")
+	}
+}
+
+func TestQueueName(t *testing.T) {
+	valid := []string{"test", "tenant-1.events_v2", strings.Repeat("a", proto.MAX_QUEUE_NAME_LENGTH)}
+	for _, s := range valid {
+		if _, err := proto.NewQueueName(s); err != nil {
+			t.Errorf("expected %q to be valid, got %v", s, err)
+		}
+	}
+	invalid := []string{"", ".hidden", "../escape", "a/b", "with space", strings.Repeat("a", proto.MAX_QUEUE_NAME_LENGTH+1)}
+	for _, s := range invalid {
+		if _, err := proto.NewQueueName(s); err == nil {
+			t.Errorf("expected %q to be invalid", s)
+		}
+	}
+	name := proto.QueueName(strings.Repeat("long-queue-name-", 3))
+	b, err := proto.Encode(&proto.Queuic{Command: proto.PEEK, QueueName: name})
+	if err != nil {
+		t.Errorf("failed to encode request: %v", err)
+	}
+	q, err := proto.Decode(b)
+	if err != nil {
+		t.Errorf("failed to decode request: %v", err)
+		return
+	}
+	if q.QueueName != name {
+		t.Errorf("unexpected queue name: %v", q.QueueName)
+	}
+	b, _ = proto.Encode(&proto.Queuic{Command: proto.PEEK, QueueName: "../escape"})
+	if _, err := proto.Decode(b); err == nil {
+		t.Errorf("expected error for invalid queue name")
+	}
+}
+
+func TestEnDecodeHeaders(t *testing.T) {
+	headers := map[string]string{"content-type": "application/json", "trace-id": "abc", "empty": ""}
+	q := proto.Queuic{
+		Command:   proto.ENQUEUE,
+		QueueName: "test",
+		QueuicItem: proto.QueuicItem{
+			Id:      uuid.New(),
+			Item:    []byte("{}"),
+			Headers: headers,
+		},
+	}
+	b, err := proto.Encode(&q)
+	if err != nil {
+		t.Errorf("failed to encode request: %v", err)
+	}
+	q2, err := proto.Decode(b)
+	if err != nil {
+		t.Errorf("failed to decode request: %v", err)
+		return
+	}
+	if !reflect.DeepEqual(q2.QueuicItem.Headers, headers) {
+		t.Errorf("unexpected headers: %v", q2.QueuicItem.Headers)
+	}
+	if string(q2.QueuicItem.Item) != "{}" {
+		t.Errorf("unexpected value: %v", q2.QueuicItem.Item)
+	}
+	batch := proto.Queuic{
+		Command:   proto.ENQUEUE_BATCH,
+		QueueName: "test",
+		Items:     []proto.QueuicItem{q.QueuicItem, {Id: uuid.New(), Item: []byte("no headers")}},
+	}
+	b, err = proto.Encode(&batch)
+	if err != nil {
+		t.Errorf("failed to encode batch: %v", err)
+	}
+	if len(b) != 2+len("test")+2+proto.BatchItemLength(batch.Items[0])+proto.BatchItemLength(batch.Items[1]) {
+		t.Errorf("unexpected batch length: %d", len(b))
+	}
+	batch2, err := proto.Decode(b)
+	if err != nil {
+		t.Errorf("failed to decode batch: %v", err)
+		return
+	}
+	if !reflect.DeepEqual(batch2.Items[0].Headers, headers) || batch2.Items[1].Headers != nil {
+		t.Errorf("unexpected batch headers: %v", batch2.Items)
+	}
+	q.QueuicItem.Headers = map[string]string{"": "empty key"}
+	if _, err := proto.Encode(&q); err == nil {
+		t.Errorf("expected error for empty header key")
+	}
+}
+
+func TestCommandString(t *testing.T) {
+	if proto.ENQUEUE.String() != "ENQUEUE" || proto.MOVE_ACK.String() != "MOVE_ACK" || proto.ERROR.String() != "ERROR" {
+		t.Errorf("command names don't match the commands")
+	}
+	if proto.Command(proto.ERROR+1).String() != fmt.Sprintf("UNKNOWN_%d", proto.ERROR+1) {
+		t.Errorf("unexpected name of an unknown command")
+	}
+}
@@ -0,0 +1,218 @@
+package queue
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/dinifarb/mlog"
+	"github.com/dinifarb/queuic/pkg/proto"
+	"github.com/google/uuid"
+)
+
+// path of a move journal in the data dir
+const movePath = "%s/%s.move"
+
+// moveJournal is written before the items leave the source and
+// updated once the destination has them. Committed tells RecoverMoves
+// that the destination must not get the items again, they may have
+// been consumed there already.
+type moveJournal struct {
+	Source      proto.QueueName
+	Destination proto.QueueName
+	Items       []proto.QueuicItem
+	Committed   bool
+}
+
+// Move moves up to max waiting items of src for which match returns
+// true to the end of dst and returns them, max 0 moves all of them.
+// In flight items are not moved. A journal makes the move crash safe, RecoverMoves finishes
+// an interrupted move so that no item is lost or duplicated.
+func Move(src *Queue, dst *Queue, match func(proto.QueuicItem) bool, max int) ([]proto.QueuicItem, error) {
+	if src == dst || src.Name == dst.Name {
+		return nil, errors.New("source and destination are the same queue")
+	}
+	journal := moveJournal{Source: src.Name, Destination: dst.Name}
+	journalPath := fmt.Sprintf(movePath, filepath.Dir(src.store.path), uuid.NewString())
+	items, err := src.take(match, max, func(items []proto.QueuicItem) error {
+		journal.Items = items
+		return writeJournal(journalPath, journal)
+	})
+	if err != nil {
+		os.Remove(journalPath)
+		return nil, fmt.Errorf("failed to take items: %w", err)
+	}
+	if len(items) == 0 {
+		return nil, nil
+	}
+	err = dst.requeueCommitted(items, func() error {
+		journal.Committed = true
+		return writeJournal(journalPath, journal)
+	})
+	if err != nil {
+		// if the items can't be put back the journal moves them on the next start
+		if restoreErr := src.restore(items); restoreErr != nil {
+			return nil, fmt.Errorf("failed to move items: %w, failed to put them back: %v", err, restoreErr)
+		}
+		os.Remove(journalPath)
+		return nil, fmt.Errorf("failed to move items: %w", err)
+	}
+	if err := os.Remove(journalPath); err != nil {
+		mlog.Warn("failed to remove move journal %s: %v", journalPath, err)
+	}
+	mlog.Info("moved %d items from queue %s to %s", len(items), src.Name.String(), dst.Name.String())
+	return items, nil
+}
+
+// RecoverMoves finishes the moves of the data dir which were interrupted by
+// a crash, it must be called after the queues are loaded and before they are used
+func RecoverMoves(dir string, getQueue func(name proto.QueueName) (*Queue, error)) error {
+	journals, err := filepath.Glob(fmt.Sprintf(movePath, dir, "*"))
+	if err != nil {
+		return err
+	}
+	for _, journalPath := range journals {
+		b, err := os.ReadFile(journalPath)
+		if err != nil {
+			return fmt.Errorf("failed to read move journal: %w", err)
+		}
+		var journal moveJournal
+		if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&journal); err != nil {
+			return fmt.Errorf("failed to decode move journal %s: %w", journalPath, err)
+		}
+		ids := make(map[uuid.UUID]struct{}, len(journal.Items))
+		for _, item := range journal.Items {
+			ids[item.Id] = struct{}{}
+		}
+		src, err := getQueue(journal.Source)
+		if err != nil {
+			return err
+		}
+		dst, err := getQueue(journal.Destination)
+		if err != nil {
+			return err
+		}
+		if !journal.Committed {
+			if err := dst.requeueMissing(journal.Items); err != nil {
+				return fmt.Errorf("failed to recover move to %s: %w", journal.Destination, err)
+			}
+		}
+		if err := src.remove(ids); err != nil {
+			return fmt.Errorf("failed to recover move from %s: %w", journal.Source, err)
+		}
+		if err := os.Remove(journalPath); err != nil {
+			return fmt.Errorf("failed to remove move journal: %w", err)
+		}
+		mlog.Info("recovered move of %d items from queue %s to %s", len(journal.Items), journal.Source.String(), journal.Destination.String())
+	}
+	return nil
+}
+
+// take removes the matching waiting items, prepare is called
+// with them before their removal is written to disk
+func (q *Queue) take(match func(proto.QueuicItem) bool, max int, prepare func(items []proto.QueuicItem) error) ([]proto.QueuicItem, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	taken := make([]proto.QueuicItem, 0)
+	kept := make([]proto.QueuicItem, 0, len(q.items))
+	for _, item := range q.items {
+		if (max <= 0 || len(taken) < max) && match(item) {
+			taken = append(taken, item)
+		} else {
+			kept = append(kept, item)
+		}
+	}
+	if len(taken) == 0 {
+		return nil, nil
+	}
+	if err := prepare(taken); err != nil {
+		return nil, err
+	}
+	items := q.items
+	q.items = kept
+	if err := q.appendRecord(record{Remove: ids(taken)}); err != nil {
+		q.items = items
+		return nil, err
+	}
+	return taken, nil
+}
+
+// restore puts taken items back to the front of the queue
+func (q *Queue) restore(items []proto.QueuicItem) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items = append(append(make([]proto.QueuicItem, 0, len(items)+len(q.items)), items...), q.items...)
+	return q.appendRecord(record{Prepend: items})
+}
+
+// requeueCommitted requeues the items and calls commit before
+// the lock is released, so they can't be peeked before commit is done
+func (q *Queue) requeueCommitted(items []proto.QueuicItem, commit func() error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := len(q.items)
+	if err := q.enqueue(items); err != nil {
+		return err
+	}
+	if err := commit(); err != nil {
+		q.items = q.items[:n]
+		q.added -= uint64(len(items))
+		if saveErr := q.saveToDisk(); saveErr != nil {
+			mlog.Error("failed to roll back move to queue %s: %v", q.Name.String(), saveErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// requeueMissing requeues the items which the queue does not have yet
+func (q *Queue) requeueMissing(items []proto.QueuicItem) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	have := make(map[uuid.UUID]struct{}, len(q.items))
+	for _, item := range q.items {
+		have[item.Id] = struct{}{}
+	}
+	missing := make([]proto.QueuicItem, 0, len(items))
+	for _, item := range items {
+		if _, ok := have[item.Id]; !ok {
+			missing = append(missing, item)
+		}
+	}
+	return q.enqueue(missing)
+}
+
+// remove drops the waiting items with the ids
+func (q *Queue) remove(ids map[uuid.UUID]struct{}) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	kept := make([]proto.QueuicItem, 0, len(q.items))
+	for _, item := range q.items {
+		if _, ok := ids[item.Id]; !ok {
+			kept = append(kept, item)
+		}
+	}
+	if len(kept) == len(q.items) {
+		return nil
+	}
+	removed := make([]uuid.UUID, 0, len(q.items)-len(kept))
+	for id := range ids {
+		removed = append(removed, id)
+	}
+	q.items = kept
+	return q.appendRecord(record{Remove: removed})
+}
+
+func writeJournal(name string, journal moveJournal) error {
+	var buff bytes.Buffer
+	if err := gob.NewEncoder(&buff).Encode(journal); err != nil {
+		return fmt.Errorf("gob error: %w", err)
+	}
+	if err := writeFile(name, buff.Bytes()); err != nil {
+		return fmt.Errorf("failed to write move journal: %w", err)
+	}
+	return nil
+}
@@ -2,10 +2,16 @@ package queue
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/dinifarb/mlog"
 	"github.com/dinifarb/queuic/pkg/proto"
@@ -13,56 +19,225 @@ import (
 )
 
 const (
-	path = "./data/%s.queuic"
+	DEFAULT_DATA_DIR = "./data"
+	// FILE_EXTENSION is the extension of the queue files in the data dir
+	FILE_EXTENSION = ".queuic"
+	// count of the latest enqueued ids which are remembered to drop duplicates
+	DEDUP_WINDOW = 10000
+	// a queue file is rewritten once its appended records are larger
+	// than COMPACT_SIZE bytes and than the items they change
+	COMPACT_SIZE = 1 << 20
+)
+
+var (
+	ErrEmpty  = errors.New("queue is empty")
+	ErrFull   = errors.New("queue is full")
+	ErrClosed = errors.New("queue is closed")
 )
 
 type Queue struct {
-	items   []proto.QueuicItem
-	peeked  map[uuid.UUID]proto.QueuicItem
-	mu      sync.Mutex
-	store   store
-	added   uint64
-	removed uint64
-	Name    proto.QueueName
+	items     []proto.QueuicItem
+	peeked    map[uuid.UUID]proto.QueuicItem
+	mu        sync.Mutex
+	store     store
+	added     uint64
+	removed   uint64
+	released  uint64
+	stats     stats
+	options   Options
+	onExpired func(items []proto.QueuicItem) error
+	observer  func(op Op, items []proto.QueuicItem)
+	seen      map[uuid.UUID]struct{}
+	seenOrder []uuid.UUID
+	closed    bool
+	Name      proto.QueueName
+}
+
+// Op is an operation on the items of a queue
+type Op string
+
+const (
+	OP_ENQUEUE Op = "enqueue"
+	OP_PEEK    Op = "peek"
+	OP_ACCEPT  Op = "accept"
+	OP_RELEASE Op = "release"
+	OP_PURGE   Op = "purge"
+	OP_EXPIRE  Op = "expire"
+)
+
+// Options are the settings of a queue, the zero value means no limits
+type Options struct {
+	// MaxLength is the max count of items including the peeked ones
+	MaxLength int
+	// TTL is the time after which a not yet peeked item expires
+	TTL time.Duration
+	// DeadLetter is the queue which receives the expired items
+	DeadLetter proto.QueueName
+}
+
+// Validate checks the options of the queue name, its expired items
+// must not move to the queue itself, they would never expire for good
+func (o Options) Validate(name proto.QueueName) error {
+	if o.DeadLetter != "" && o.DeadLetter == name {
+		return fmt.Errorf("dead letter queue %s must not be the queue itself", name)
+	}
+	return nil
 }
 
 type store struct {
-	file os.File
+	path string
 	mu   sync.Mutex
+	// bytes of the items written by the last rewrite and of the records after them
+	snapshot int64
+	records  int64
+	// rewrite is set if the records on disk must not be appended to
+	rewrite bool
+}
+
+// record is a change of the waiting items appended to the queue file,
+// the in flight items are not written so accepting them changes nothing
+type record struct {
+	Remove  []uuid.UUID
+	Prepend []proto.QueuicItem
+	Append  []proto.QueuicItem
 }
 
 func NewQueue(name proto.QueueName) (*Queue, error) {
+	return NewQueueInDir(DEFAULT_DATA_DIR, name)
+}
+
+// NewQueueInDir loads the queue from its file in dir or creates the file
+func NewQueueInDir(dir string, name proto.QueueName) (*Queue, error) {
+	if err := name.Validate(); err != nil {
+		return nil, err
+	}
 	q := &Queue{
 		Name: name,
 	}
 	q.items = make([]proto.QueuicItem, 0)
 	q.peeked = make(map[uuid.UUID]proto.QueuicItem)
-	fileName := fmt.Sprintf(path, name.String())
-	if _, err := os.Stat(fileName); os.IsNotExist(err) {
-		f, err := os.Create(fileName)
-		if err != nil {
+	q.seen = make(map[uuid.UUID]struct{})
+	q.store.path = filepath.Join(dir, name.String()+FILE_EXTENSION)
+	if err := os.MkdirAll(filepath.Dir(q.store.path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data dir: %w", err)
+	}
+	if _, err := os.Stat(q.store.path); os.IsNotExist(err) {
+		if err := writeFile(q.store.path, nil); err != nil {
 			return nil, fmt.Errorf("failed to create bin file: %w", err)
 		}
-		q.store.file = *f
-	} else {
-		f, err := os.OpenFile(fileName, os.O_RDWR, 0644)
-		if err != nil {
-			return nil, fmt.Errorf("failed to open bin file: %w", err)
-		}
-		q.store.file = *f
-		if err := q.loadFromDisk(); err != nil {
-			return nil, fmt.Errorf("failed to load from disk: %w", err)
-		}
+	} else if err := q.loadFromDisk(); err != nil {
+		return nil, fmt.Errorf("failed to load from disk: %w", err)
 	}
 	return q, nil
 }
 
+func (q *Queue) SetOptions(options Options) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.options = options
+}
+
+func (q *Queue) Options() Options {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.options
+}
+
+// SetExpiredHandler sets the func which receives the items removed
+// because of their TTL, without a handler they are dropped. If the
+// handler fails the items are put back to the head of the queue.
+func (q *Queue) SetExpiredHandler(handler func(items []proto.QueuicItem) error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.onExpired = handler
+}
+
+// SetObserver sets the func which is called after every operation
+// with the affected items. It is called with the lock of the queue
+// held, so it must neither block nor call the queue.
+func (q *Queue) SetObserver(observer func(op Op, items []proto.QueuicItem)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.observer = observer
+}
+
+func (q *Queue) notify(op Op, items []proto.QueuicItem) {
+	if q.observer != nil && len(items) > 0 {
+		q.observer(op, items)
+	}
+}
+
+// Enqueue appends the item, an item with the id of a recently
+// enqueued item is a duplicate and ignored.
 func (q *Queue) Enqueue(item proto.QueuicItem) error {
+	return q.EnqueueBatch([]proto.QueuicItem{item})
+}
+
+// EnqueueBatch appends all items with a single write to disk.
+// Either all items are enqueued or none of them, duplicates are ignored.
+func (q *Queue) EnqueueBatch(items []proto.QueuicItem) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	unique := make([]proto.QueuicItem, 0, len(items))
+	ids := make(map[uuid.UUID]struct{}, len(items))
+	for _, item := range items {
+		if _, ok := q.seen[item.Id]; ok {
+			mlog.Debug("dropped duplicate item %v of queue %s", item.Id, q.Name.String())
+			continue
+		}
+		if _, ok := ids[item.Id]; ok {
+			continue
+		}
+		ids[item.Id] = struct{}{}
+		unique = append(unique, item)
+	}
+	return q.enqueue(unique)
+}
+
+// Requeue appends items which come from another queue, like expired items
+// for a dead letter queue. They are not checked for duplicates.
+func (q *Queue) Requeue(items []proto.QueuicItem) error {
 	q.mu.Lock()
 	defer q.mu.Unlock()
-	q.items = append(q.items, item)
-	q.added++
-	return q.saveToDisk()
+	return q.enqueue(items)
+}
+
+func (q *Queue) enqueue(items []proto.QueuicItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	if err := q.checkLength(len(items)); err != nil {
+		return err
+	}
+	n := len(q.items)
+	now := time.Now()
+	for _, item := range items {
+		item.Timestamp = now
+		q.items = append(q.items, item)
+	}
+	if err := q.appendRecord(record{Append: q.items[n:]}); err != nil {
+		q.items = q.items[:n]
+		return err
+	}
+	for _, item := range items {
+		q.remember(item.Id)
+	}
+	q.added += uint64(len(items))
+	q.stats.enqueue(now, len(items))
+	q.notify(OP_ENQUEUE, q.items[n:])
+	return nil
+}
+
+func (q *Queue) remember(id uuid.UUID) {
+	if _, ok := q.seen[id]; ok {
+		return
+	}
+	q.seen[id] = struct{}{}
+	q.seenOrder = append(q.seenOrder, id)
+	if len(q.seenOrder) > DEDUP_WINDOW {
+		delete(q.seen, q.seenOrder[0])
+		q.seenOrder = q.seenOrder[1:]
+	}
 }
 
 func (q *Queue) Size() int {
@@ -83,64 +258,384 @@ func (q *Queue) Dequeued() uint64 {
 	return q.removed
 }
 
+// Metrics is a snapshot of the counters and gauges of a queue
+type Metrics struct {
+	Waiting  int
+	InFlight int
+	Enqueued uint64
+	Dequeued uint64
+	Released uint64
+	// Oldest is the enqueue time of the first waiting item,
+	// zero if no item is waiting
+	Oldest time.Time
+	// items per second over the last minute and the last five minutes
+	EnqueueRate1m float64
+	EnqueueRate5m float64
+	DequeueRate1m float64
+	DequeueRate5m float64
+	// AvgWait is the mean time from enqueue to peek and AvgProcessing
+	// the mean time from peek to accept, both over the last five minutes
+	AvgWait       time.Duration
+	AvgProcessing time.Duration
+}
+
+func (q *Queue) Metrics() Metrics {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	m := Metrics{
+		Waiting:       len(q.items),
+		InFlight:      len(q.peeked),
+		Enqueued:      q.added,
+		Dequeued:      q.removed,
+		Released:      q.released,
+		EnqueueRate1m: q.stats.enqueued.rate(now, time.Minute),
+		EnqueueRate5m: q.stats.enqueued.rate(now, STATS_WINDOW),
+		DequeueRate1m: q.stats.dequeued.rate(now, time.Minute),
+		DequeueRate5m: q.stats.dequeued.rate(now, STATS_WINDOW),
+		AvgWait:       q.stats.waited.average(now, STATS_WINDOW),
+		AvgProcessing: q.stats.processed.average(now, STATS_WINDOW),
+	}
+	if len(q.items) > 0 {
+		m.Oldest = q.items[0].Timestamp
+	}
+	return m
+}
+
 func (q *Queue) Peek() (proto.QueuicItem, error) {
+	expired := q.expire()
+	q.handleExpired(expired)
 	q.mu.Lock()
 	defer q.mu.Unlock()
 	if len(q.items) == 0 {
-		return proto.QueuicItem{}, fmt.Errorf("queue is empty")
+		return proto.QueuicItem{}, ErrEmpty
 	}
 	item := q.items[0]
 	q.items = q.items[1:]
 	q.peeked[item.Id] = item
-	err := q.saveToDisk()
+	err := q.appendRecord(record{Remove: []uuid.UUID{item.Id}})
 	if err != nil {
 		return proto.QueuicItem{}, err
 	}
+	q.stats.peek(time.Now(), []proto.QueuicItem{item})
+	q.notify(OP_PEEK, []proto.QueuicItem{item})
 	return item, nil
 }
 
+// PeekBatch peeks up to max items. It stops early when the next item
+// would push the batch over maxBytes, but always returns at least one item.
+func (q *Queue) PeekBatch(max int, maxBytes int) ([]proto.QueuicItem, error) {
+	expired := q.expire()
+	q.handleExpired(expired)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		return nil, ErrEmpty
+	}
+	n, size := 0, 0
+	for n < max && n < len(q.items) {
+		size += proto.BatchItemLength(q.items[n])
+		if n > 0 && size > maxBytes {
+			break
+		}
+		n++
+	}
+	items := q.items[:n:n]
+	q.items = q.items[n:]
+	for _, item := range items {
+		q.peeked[item.Id] = item
+	}
+	if err := q.appendRecord(record{Remove: ids(items)}); err != nil {
+		return nil, err
+	}
+	q.stats.peek(time.Now(), items)
+	q.notify(OP_PEEK, items)
+	return items, nil
+}
+
+// InFlight reports whether the item is peeked and not yet accepted or released
+func (q *Queue) InFlight(id uuid.UUID) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, ok := q.peeked[id]
+	return ok
+}
+
+// inFlight returns the peeked items ordered by their enqueue time
+func (q *Queue) inFlight() []proto.QueuicItem {
+	inFlight := make([]proto.QueuicItem, 0, len(q.peeked))
+	for _, item := range q.peeked {
+		inFlight = append(inFlight, item)
+	}
+	sort.Slice(inFlight, func(i, j int) bool {
+		if inFlight[i].Timestamp.Equal(inFlight[j].Timestamp) {
+			return inFlight[i].Id.String() < inFlight[j].Id.String()
+		}
+		return inFlight[i].Timestamp.Before(inFlight[j].Timestamp)
+	})
+	return inFlight
+}
+
+// BrowsedItem is an item of the queue and whether it is in flight
+type BrowsedItem struct {
+	proto.QueuicItem
+	InFlight bool
+}
+
+// Browse returns up to limit items starting at offset and the total
+// count of items without changing their state. The in flight items come
+// first ordered by their enqueue time, followed by the waiting items.
+func (q *Queue) Browse(offset int, limit int) ([]BrowsedItem, int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	total := len(q.peeked) + len(q.items)
+	if offset >= total || limit <= 0 {
+		return []BrowsedItem{}, total
+	}
+	inFlight := q.inFlight()
+	items := make([]BrowsedItem, 0, limit)
+	for i := offset; i < total && len(items) < limit; i++ {
+		if i < len(inFlight) {
+			items = append(items, BrowsedItem{QueuicItem: inFlight[i], InFlight: true})
+		} else {
+			items = append(items, BrowsedItem{QueuicItem: q.items[i-len(inFlight)]})
+		}
+	}
+	return items, total
+}
+
 func (q *Queue) Release(id uuid.UUID) error {
+	return q.ReleaseBatch([]uuid.UUID{id})
+}
+
+// ReleaseBatch puts the peeked items back to the front of the queue
+// in the given order. Ids which are not peeked are ignored.
+func (q *Queue) ReleaseBatch(ids []uuid.UUID) error {
 	q.mu.Lock()
 	defer q.mu.Unlock()
-	//copy peeked to to 0 on items
-	q.items = append([]proto.QueuicItem{q.peeked[id]}, q.items...)
-	delete(q.peeked, id)
-	return q.saveToDisk()
+	released := make([]proto.QueuicItem, 0, len(ids))
+	for _, id := range ids {
+		item, ok := q.peeked[id]
+		if !ok {
+			continue
+		}
+		released = append(released, item)
+		delete(q.peeked, id)
+	}
+	q.items = append(released, q.items...)
+	if err := q.appendRecord(record{Prepend: released}); err != nil {
+		return err
+	}
+	q.released += uint64(len(released))
+	q.stats.forget(released)
+	q.notify(OP_RELEASE, released)
+	return nil
 }
 
 func (q *Queue) Accept(id uuid.UUID) error {
+	return q.AcceptBatch([]uuid.UUID{id})
+}
+
+// AcceptBatch removes the peeked items for good.
+// Ids which are not peeked are ignored.
+func (q *Queue) AcceptBatch(ids []uuid.UUID) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	accepted := make([]proto.QueuicItem, 0, len(ids))
+	for _, id := range ids {
+		item, ok := q.peeked[id]
+		if !ok {
+			continue
+		}
+		accepted = append(accepted, item)
+		delete(q.peeked, id)
+		q.removed++
+	}
+	if q.closed {
+		return ErrClosed
+	}
+	q.stats.accept(time.Now(), accepted)
+	q.notify(OP_ACCEPT, accepted)
+	return nil
+}
+
+// Purge removes all items which are not peeked, with inFlight also the
+// peeked ones, which then can't be accepted or released anymore.
+// It returns how many items have been removed.
+func (q *Queue) Purge(inFlight bool) (int, error) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
-	delete(q.peeked, id)
-	q.removed++
-	return q.saveToDisk()
+	items, peeked := q.items, q.peeked
+	n := len(q.items)
+	q.items = make([]proto.QueuicItem, 0)
+	if inFlight {
+		n += len(q.peeked)
+		q.peeked = make(map[uuid.UUID]proto.QueuicItem)
+	}
+	if err := q.saveToDisk(); err != nil {
+		q.items, q.peeked = items, peeked
+		return 0, err
+	}
+	purged := items
+	if inFlight {
+		purged = make([]proto.QueuicItem, 0, n)
+		purged = append(purged, items...)
+		for _, item := range peeked {
+			purged = append(purged, item)
+		}
+		q.stats.peekedAt = nil
+	}
+	q.notify(OP_PURGE, purged)
+	return n, nil
 }
 
+// Close writes the in flight items to disk in front of the waiting ones,
+// so they are delivered again after a restart. Every change of the queue
+// after Close fails with ErrClosed.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil
+	}
+	waiting := q.items
+	q.items = append(q.inFlight(), waiting...)
+	err := q.saveToDisk()
+	q.items = waiting
+	if err != nil {
+		return err
+	}
+	q.closed = true
+	return nil
+}
+
+// Delete removes the files of the queue, every later call which writes
+// the queue fails with ErrClosed so the file is not created again.
 func (q *Queue) Delete() error {
 	q.mu.Lock()
 	defer q.mu.Unlock()
-	q.store.file.Close()
-	fileName := fmt.Sprintf(path, q.Name.String())
-	if err := os.Remove(fileName); err != nil {
+	q.closed = true
+	q.store.mu.Lock()
+	defer q.store.mu.Unlock()
+	// a write which failed may have left its temporary file
+	if err := os.Remove(q.store.path + ".tmp"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove temporary queue file: %w", err)
+	}
+	if err := os.Remove(q.store.path); err != nil {
 		return fmt.Errorf("failed to remove queue file: %w", err)
 	}
 	return nil
 }
 
+func (q *Queue) checkLength(n int) error {
+	if q.options.MaxLength > 0 && len(q.items)+len(q.peeked)+n > q.options.MaxLength {
+		return fmt.Errorf("%w, max length is %d", ErrFull, q.options.MaxLength)
+	}
+	return nil
+}
+
+// expire removes the expired items from the head of the queue
+func (q *Queue) expire() []proto.QueuicItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.options.TTL <= 0 {
+		return nil
+	}
+	deadline := time.Now().Add(-q.options.TTL)
+	n := 0
+	for n < len(q.items) && q.items[n].Timestamp.Before(deadline) {
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	expired := q.items[:n:n]
+	q.items = q.items[n:]
+	if err := q.appendRecord(record{Remove: ids(expired)}); err != nil {
+		mlog.Error("failed to save expired items of queue %s: %v", q.Name.String(), err)
+		q.items = append(expired, q.items...)
+		return nil
+	}
+	return expired
+}
+
+// handleExpired must be called without holding the lock
+// as the handler usually enqueues to another queue
+func (q *Queue) handleExpired(expired []proto.QueuicItem) {
+	if len(expired) == 0 {
+		return
+	}
+	q.mu.Lock()
+	handler := q.onExpired
+	q.mu.Unlock()
+	if handler == nil {
+		mlog.Debug("dropped %d expired items from queue %s", len(expired), q.Name.String())
+	} else if err := handler(expired); err != nil {
+		// the items are handled again when they expire on the next peek,
+		// until then they can be peeked like the other items
+		mlog.Error("kept %d expired items in queue %s: %v", len(expired), q.Name.String(), err)
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.items = append(expired, q.items...)
+		if err := q.appendRecord(record{Prepend: expired}); err != nil {
+			mlog.Error("failed to save the kept expired items of queue %s: %v", q.Name.String(), err)
+		}
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.notify(OP_EXPIRE, expired)
+}
+
+// saveToDisk rewrites the queue file with the waiting items
 func (q *Queue) saveToDisk() error {
+	if q.closed {
+		return ErrClosed
+	}
+	q.store.mu.Lock()
+	defer q.store.mu.Unlock()
+	return q.rewrite()
+}
+
+// appendRecord appends the change of the waiting items to the queue file,
+// which is rewritten instead once the records outgrow the items
+func (q *Queue) appendRecord(r record) error {
+	if q.closed {
+		return ErrClosed
+	}
 	q.store.mu.Lock()
 	defer q.store.mu.Unlock()
-	if len(q.items) == 0 && len(q.peeked) == 0 {
-		return q.replaceFile()
+	// the records follow the items, an empty file has none yet
+	if q.store.rewrite || q.store.snapshot == 0 || q.store.records >= COMPACT_SIZE && q.store.records >= q.store.snapshot {
+		return q.rewrite()
+	}
+	// every record has its own encoder, the length in front of it
+	// tells whether a crash cut it off
+	buff := bytes.NewBuffer(make([]byte, 4))
+	if err := gob.NewEncoder(buff).Encode(r); err != nil {
+		return fmt.Errorf("gob error: %w", err)
 	}
+	b := buff.Bytes()
+	binary.LittleEndian.PutUint32(b, uint32(len(b)-4))
+	if err := appendFile(q.store.path, q.store.snapshot+q.store.records, b); err != nil {
+		q.store.rewrite = true
+		return fmt.Errorf("failed to append record to disk: %w", err)
+	}
+	q.store.records += int64(len(b))
+	return nil
+}
+
+// rewrite must be called holding the store lock
+func (q *Queue) rewrite() error {
 	var buff bytes.Buffer
 	enc := gob.NewEncoder(&buff)
 	if err := enc.Encode(q.items); err != nil {
 		return fmt.Errorf("gob error: %w", err)
 	}
-	if _, err := q.store.file.Write(buff.Bytes()); err != nil {
+	if err := writeFile(q.store.path, buff.Bytes()); err != nil {
 		return fmt.Errorf("failed to write bytes to disk: %w", err)
 	}
+	q.store.snapshot, q.store.records, q.store.rewrite = int64(buff.Len()), 0, false
 	mlog.Debug("saved to disk - items %d, peeked %d", len(q.items), len(q.peeked))
 	return nil
 }
@@ -148,26 +643,121 @@ func (q *Queue) saveToDisk() error {
 func (q *Queue) loadFromDisk() error {
 	q.store.mu.Lock()
 	defer q.store.mu.Unlock()
-	dec := gob.NewDecoder(&q.store.file)
-	if err := dec.Decode(&q.items); err != nil {
-		if err.Error() == "EOF" {
+	b, err := os.ReadFile(q.store.path)
+	if err != nil {
+		return fmt.Errorf("failed to open bin file: %w", err)
+	}
+	r := bytes.NewReader(b)
+	if err := gob.NewDecoder(r).Decode(&q.items); err != nil {
+		if err == io.EOF {
 			//EMPTY FILE
 			return nil
 		}
 		return fmt.Errorf("failed to read bytes from disk: %w", err)
 	}
+	q.store.snapshot = int64(len(b) - r.Len())
+	q.store.records = int64(r.Len())
+	for r.Len() >= 4 {
+		n := int(binary.LittleEndian.Uint32(b[len(b)-r.Len():]))
+		if r.Len()-4 < n {
+			break
+		}
+		r.Seek(4, io.SeekCurrent)
+		var rec record
+		if err := gob.NewDecoder(io.LimitReader(r, int64(n))).Decode(&rec); err != nil {
+			return fmt.Errorf("failed to read record from disk: %w", err)
+		}
+		q.items = apply(q.items, rec)
+	}
+	if r.Len() > 0 {
+		// the write of the last record was cut off by a crash,
+		// its operation has failed
+		mlog.Warn("dropped %d bytes of an incomplete record of queue %s", r.Len(), q.Name.String())
+	}
+	// the records are merged into the items on the next write
+	q.store.rewrite = q.store.records > 0
+	for _, item := range q.items {
+		q.remember(item.Id)
+	}
 	return nil
 }
 
-func (q *Queue) replaceFile() error {
-	q.store.file.Close()
-	fileName := fmt.Sprintf(path, q.Name.String())
-	if err := os.Remove(fileName); err != nil {
-		return fmt.Errorf("failed to remove file: %w", err)
+// apply returns the items changed by the record
+func apply(items []proto.QueuicItem, r record) []proto.QueuicItem {
+	if len(r.Remove) > 0 {
+		removed := make(map[uuid.UUID]struct{}, len(r.Remove))
+		for _, id := range r.Remove {
+			removed[id] = struct{}{}
+		}
+		kept := make([]proto.QueuicItem, 0, len(items))
+		for _, item := range items {
+			if _, ok := removed[item.Id]; !ok {
+				kept = append(kept, item)
+			}
+		}
+		items = kept
+	}
+	if len(r.Prepend) > 0 {
+		items = append(r.Prepend, items...)
+	}
+	return append(items, r.Append...)
+}
+
+func ids(items []proto.QueuicItem) []uuid.UUID {
+	ids := make([]uuid.UUID, len(items))
+	for i, item := range items {
+		ids[i] = item.Id
 	}
-	_, err := os.Create(fileName)
+	return ids
+}
+
+// writeFile replaces the file by writing a temporary file and
+// renaming it, so a crash leaves either the old or the new content
+func writeFile(name string, data []byte) error {
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+		return err
 	}
-	return nil
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return err
+	}
+	// the rename is only durable once the directory is synced
+	dir, err := os.Open(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// appendFile writes data at the end of the file of size and syncs it,
+// if that fails the file is cut back to its size
+func appendFile(name string, size int64, data []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(data, size); err != nil {
+		f.Truncate(size)
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Truncate(size)
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
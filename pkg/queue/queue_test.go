@@ -1,9 +1,16 @@
 package queue_test
 
 import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/dinifarb/mlog"
 	"github.com/dinifarb/queuic/pkg/proto"
@@ -17,8 +24,7 @@ func TestQueueEnqueuePeekAccept(t *testing.T) {
 	if _, err := os.Stat(fileName); !os.IsNotExist(err) {
 		os.Remove(fileName)
 	}
-	name := proto.QueueName{}
-	copy(name[:], []byte("epa"))
+	name := proto.QueueName("epa")
 	q, err := queue.NewQueue(name)
 	if err != nil {
 		mlog.Error("%v", err)
@@ -75,3 +81,385 @@ func TestQueueEnqueuePeekAccept(t *testing.T) {
 	}
 	mlog.SetLevel(mlog.Ltrace)
 }
+
+func TestQueueBatch(t *testing.T) {
+	fileName := "./data/batch.queuic"
+	if _, err := os.Stat(fileName); !os.IsNotExist(err) {
+		os.Remove(fileName)
+	}
+	name := proto.QueueName("batch")
+	q, err := queue.NewQueue(name)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	items := make([]proto.QueuicItem, 10)
+	for i := range items {
+		items[i] = proto.QueuicItem{Id: uuid.New(), Item: []byte("batch")}
+	}
+	if err := q.EnqueueBatch(items); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if q.Enqueued() != 10 {
+		t.Errorf("Expected 10 enqueued, got %d", q.Enqueued())
+	}
+	peeked, err := q.PeekBatch(4, 1024)
+	if err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if len(peeked) != 4 || peeked[0].Id != items[0].Id {
+		t.Errorf("Expected the first 4 items, got %v", peeked)
+	}
+	if err := q.ReleaseBatch([]uuid.UUID{peeked[2].Id, peeked[3].Id}); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if err := q.AcceptBatch([]uuid.UUID{peeked[0].Id, peeked[1].Id, uuid.New()}); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if q.Dequeued() != 2 {
+		t.Errorf("Expected 2 dequeued, got %d", q.Dequeued())
+	}
+	// a byte limit smaller than one item still returns a single item
+	peeked, err = q.PeekBatch(8, 1)
+	if err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if len(peeked) != 1 || peeked[0].Id != items[2].Id {
+		t.Errorf("Expected released item first, got %v", peeked)
+	}
+	if q.Size() != 8 {
+		t.Errorf("Expected size 8, got %d", q.Size())
+	}
+}
+
+func TestQueueHeadersPersisted(t *testing.T) {
+	fileName := "./data/headers.queuic"
+	if _, err := os.Stat(fileName); !os.IsNotExist(err) {
+		os.Remove(fileName)
+	}
+	q, err := queue.NewQueue("headers")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	headers := map[string]string{"content-type": "text/plain", "source": "test"}
+	if err := q.Enqueue(proto.QueuicItem{Id: uuid.New(), Item: []byte("test"), Headers: headers}); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	loaded, err := queue.NewQueue("headers")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	item, err := loaded.Peek()
+	if err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(item.Headers, headers) {
+		t.Errorf("Expected headers %v, got %v", headers, item.Headers)
+	}
+}
+
+func TestQueueDropsDuplicates(t *testing.T) {
+	fileName := "./data/dedup.queuic"
+	if _, err := os.Stat(fileName); !os.IsNotExist(err) {
+		os.Remove(fileName)
+	}
+	q, err := queue.NewQueue("dedup")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	item := proto.QueuicItem{Id: uuid.New(), Item: []byte("once")}
+	if err := q.Enqueue(item); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	other := proto.QueuicItem{Id: uuid.New(), Item: []byte("other")}
+	if err := q.EnqueueBatch([]proto.QueuicItem{item, other, other}); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if q.Size() != 2 || q.Enqueued() != 2 {
+		t.Errorf("Expected 2 items, got size %d, enqueued %d", q.Size(), q.Enqueued())
+	}
+	// the ids of the items on disk are remembered after a restart
+	loaded, err := queue.NewQueue("dedup")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := loaded.Enqueue(item); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if loaded.Size() != 2 {
+		t.Errorf("Expected size 2, got %d", loaded.Size())
+	}
+}
+
+func TestQueueBrowse(t *testing.T) {
+	q, err := queue.NewQueue("browse-test")
+	if err != nil {
+		t.Fatalf("failed to create queue: %v", err)
+	}
+	defer q.Delete()
+	for i := 0; i < 5; i++ {
+		if err := q.Enqueue(proto.QueuicItem{Id: uuid.New(), Item: []byte{byte(i)}}); err != nil {
+			t.Errorf("failed to enqueue: %v", err)
+		}
+	}
+	peeked, err := q.Peek()
+	if err != nil {
+		t.Errorf("failed to peek: %v", err)
+	}
+	items, total := q.Browse(0, 2)
+	if total != 5 || len(items) != 2 || items[0].Id != peeked.Id || !items[0].InFlight || items[1].InFlight {
+		t.Errorf("unexpected first page: %d %+v", total, items)
+	}
+	items, _ = q.Browse(4, 2)
+	if len(items) != 1 || items[0].Item[0] != 4 {
+		t.Errorf("unexpected last page: %+v", items)
+	}
+	if !q.InFlight(peeked.Id) || q.Size() != 5 {
+		t.Errorf("browse changed the state of the queue")
+	}
+}
+
+func TestQueueMove(t *testing.T) {
+	src, _ := queue.NewQueue("move-src")
+	defer src.Delete()
+	dst, _ := queue.NewQueue("move-dst")
+	defer dst.Delete()
+	for i := 0; i < 4; i++ {
+		src.Enqueue(proto.QueuicItem{Id: uuid.New(), Item: []byte{byte(i)}, Headers: map[string]string{"even": fmt.Sprint(i%2 == 0)}})
+	}
+	moved, err := queue.Move(src, dst, func(item proto.QueuicItem) bool { return item.Headers["even"] == "true" }, 0)
+	if n := len(moved); err != nil || n != 2 || src.Size() != 2 || dst.Size() != 2 {
+		t.Errorf("unexpected move of %d items: %v, sizes %d %d", len(moved), err, src.Size(), dst.Size())
+	}
+	moved, err = queue.Move(src, dst, func(proto.QueuicItem) bool { return true }, 1)
+	if n := len(moved); err != nil || n != 1 || src.Size() != 1 || dst.Size() != 3 {
+		t.Errorf("unexpected move of %d items: %v, sizes %d %d", len(moved), err, src.Size(), dst.Size())
+	}
+	items, _ := dst.PeekBatch(3, 4096)
+	if len(items) != 3 || items[0].Item[0] != 0 || items[1].Item[0] != 2 || items[2].Item[0] != 1 {
+		t.Errorf("unexpected order of moved items: %+v", items)
+	}
+	if files, _ := filepath.Glob("./data/*.move"); len(files) != 0 {
+		t.Errorf("move journals left: %v", files)
+	}
+}
+
+// moveJournal has the fields of the journal of an interrupted move
+type moveJournal struct {
+	Source      proto.QueueName
+	Destination proto.QueueName
+	Items       []proto.QueuicItem
+	Committed   bool
+}
+
+func TestQueueRecoverMoves(t *testing.T) {
+	src, _ := queue.NewQueue("recover-src")
+	defer src.Delete()
+	dst, _ := queue.NewQueue("recover-dst")
+	defer dst.Delete()
+	a := proto.QueuicItem{Id: uuid.New(), Item: []byte("a")}
+	b := proto.QueuicItem{Id: uuid.New(), Item: []byte("b")}
+	src.EnqueueBatch([]proto.QueuicItem{a, b})
+	// a crashed before the destination had it, b after it was committed
+	for i, journal := range []moveJournal{
+		{Source: src.Name, Destination: dst.Name, Items: []proto.QueuicItem{a}},
+		{Source: src.Name, Destination: dst.Name, Items: []proto.QueuicItem{b}, Committed: true},
+	} {
+		var buff bytes.Buffer
+		gob.NewEncoder(&buff).Encode(journal)
+		os.WriteFile(fmt.Sprintf("./data/recover-%d.move", i), buff.Bytes(), 0644)
+	}
+	err := queue.RecoverMoves(queue.DEFAULT_DATA_DIR, func(name proto.QueueName) (*queue.Queue, error) {
+		if name == src.Name {
+			return src, nil
+		}
+		return dst, nil
+	})
+	if err != nil {
+		t.Errorf("failed to recover moves: %v", err)
+	}
+	items, _ := dst.PeekBatch(10, 4096)
+	if src.Size() != 0 || len(items) != 1 || items[0].Id != a.Id {
+		t.Errorf("unexpected queues after recovery: source %d items, destination %+v", src.Size(), items)
+	}
+	if files, _ := filepath.Glob("./data/*.move"); len(files) != 0 {
+		t.Errorf("move journals left: %v", files)
+	}
+}
+
+func TestQueuePurge(t *testing.T) {
+	q, _ := queue.NewQueue("purge-test")
+	defer q.Delete()
+	for i := 0; i < 3; i++ {
+		q.Enqueue(proto.QueuicItem{Id: uuid.New(), Item: []byte{byte(i)}})
+	}
+	peeked, _ := q.Peek()
+	if n, err := q.Purge(false); err != nil || n != 2 || !q.InFlight(peeked.Id) {
+		t.Errorf("expected 2 purged items and 1 in flight, got %d, %v", n, err)
+	}
+	q.Enqueue(proto.QueuicItem{Id: uuid.New(), Item: []byte("new")})
+	if n, err := q.Purge(true); err != nil || n != 2 || q.Size() != 0 {
+		t.Errorf("expected 2 purged items, got %d, %v, size %d", n, err, q.Size())
+	}
+	if err := q.Accept(peeked.Id); err != nil || q.Dequeued() != 0 {
+		t.Errorf("accept of a purged item changed the queue: %v", err)
+	}
+	loaded, err := queue.NewQueue("purge-test")
+	if err != nil || loaded.Size() != 0 {
+		t.Errorf("expected empty queue on disk, got %d items, %v", loaded.Size(), err)
+	}
+}
+
+func TestQueueMetrics(t *testing.T) {
+	q, _ := queue.NewQueue("metrics-test")
+	defer q.Delete()
+	for i := 0; i < 3; i++ {
+		q.Enqueue(proto.QueuicItem{Id: uuid.New(), Item: []byte{byte(i)}})
+	}
+	time.Sleep(10 * time.Millisecond)
+	items, _ := q.PeekBatch(2, 1024)
+	time.Sleep(10 * time.Millisecond)
+	q.Accept(items[0].Id)
+	q.Release(items[1].Id)
+	m := q.Metrics()
+	if m.Waiting != 2 || m.InFlight != 0 || m.Enqueued != 3 || m.Dequeued != 1 || m.Released != 1 {
+		t.Errorf("unexpected counts: %+v", m)
+	}
+	if m.EnqueueRate1m <= 0 || m.DequeueRate5m <= 0 || m.EnqueueRate5m > m.EnqueueRate1m {
+		t.Errorf("unexpected rates: %+v", m)
+	}
+	if m.AvgWait < 10*time.Millisecond || m.AvgProcessing < 10*time.Millisecond {
+		t.Errorf("expected at least 10ms wait and processing time, got %v and %v", m.AvgWait, m.AvgProcessing)
+	}
+	if m.Oldest.IsZero() {
+		t.Errorf("expected the time of the oldest item")
+	}
+}
+
+func TestQueueClose(t *testing.T) {
+	q, _ := queue.NewQueue("close-test")
+	defer q.Delete()
+	for i := 0; i < 3; i++ {
+		q.Enqueue(proto.QueuicItem{Id: uuid.New(), Item: []byte{byte(i)}})
+	}
+	peeked, _ := q.Peek()
+	if err := q.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	if err := q.Enqueue(proto.QueuicItem{Id: uuid.New(), Item: []byte("late")}); !errors.Is(err, queue.ErrClosed) {
+		t.Errorf("expected ErrClosed after close, got %v", err)
+	}
+	loaded, err := queue.NewQueue("close-test")
+	if err != nil || loaded.Size() != 3 {
+		t.Fatalf("expected 3 items after close, got %d, %v", loaded.Size(), err)
+	}
+	if item, _ := loaded.Peek(); item.Id != peeked.Id {
+		t.Errorf("expected the in flight item first, got %v", item.Id)
+	}
+}
+
+func TestQueueDelete(t *testing.T) {
+	fileName := "./data/delete-test.queuic"
+	q, _ := queue.NewQueue("delete-test")
+	q.Enqueue(proto.QueuicItem{Id: uuid.New(), Item: []byte("first")})
+	// a temporary file left by a failed write is removed as well
+	os.WriteFile(fileName+".tmp", []byte("partial"), 0644)
+	if err := q.Delete(); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+	if err := q.Enqueue(proto.QueuicItem{Id: uuid.New(), Item: []byte("late")}); !errors.Is(err, queue.ErrClosed) {
+		t.Errorf("expected ErrClosed after delete, got %v", err)
+	}
+	for _, name := range []string{fileName, fileName + ".tmp"} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, got %v", name, err)
+		}
+	}
+}
+
+func TestQueueRecords(t *testing.T) {
+	fileName := "./data/records-test.queuic"
+	q, _ := queue.NewQueue("records-test")
+	defer q.Delete()
+	items := make([]proto.QueuicItem, 4)
+	for i := range items {
+		items[i] = proto.QueuicItem{Id: uuid.New(), Item: []byte{byte(i)}}
+	}
+	q.EnqueueBatch(items[:3])
+	peeked, _ := q.PeekBatch(2, 1024)
+	q.Release(peeked[1].Id)
+	q.Accept(peeked[0].Id)
+	q.Enqueue(items[3])
+	// the queue is loaded from the records without being closed,
+	// a record cut off by a crash is dropped
+	f, _ := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte{200, 0, 0, 0, 1})
+	f.Close()
+	want := []uuid.UUID{items[1].Id, items[2].Id, items[3].Id}
+	for i := 0; i < 2; i++ {
+		loaded, err := queue.NewQueue("records-test")
+		if err != nil {
+			t.Fatalf("failed to load: %v", err)
+		}
+		browsed, _ := loaded.Browse(0, 10)
+		got := make([]uuid.UUID, len(browsed))
+		for i, item := range browsed {
+			got[i] = item.Id
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %v after load, got %v", want, got)
+		}
+		// the next write replaces the incomplete record
+		loaded.Peek()
+		want = want[1:]
+	}
+}
+
+func TestQueueRecordsRewrite(t *testing.T) {
+	fileName := "./data/rewrite-test.queuic"
+	q, _ := queue.NewQueue("rewrite-test")
+	defer q.Delete()
+	for i := 0; i < 30; i++ {
+		q.Enqueue(proto.QueuicItem{Id: uuid.New(), Item: make([]byte, 64*1024)})
+		item, _ := q.Peek()
+		q.Accept(item.Id)
+	}
+	last := proto.QueuicItem{Id: uuid.New(), Item: []byte("last")}
+	q.Enqueue(last)
+	// once the records outgrow the items the file is rewritten
+	if info, err := os.Stat(fileName); err != nil || info.Size() >= 30*64*1024 {
+		t.Errorf("expected the file to be rewritten, got %v", err)
+	}
+	loaded, err := queue.NewQueue("rewrite-test")
+	if err != nil || loaded.Size() != 1 {
+		t.Fatalf("expected 1 item after load, got %d, %v", loaded.Size(), err)
+	}
+	if item, _ := loaded.Peek(); item.Id != last.Id {
+		t.Errorf("expected the last item, got %v", item.Id)
+	}
+}
+
+// BenchmarkQueue measures the enqueue, peek and accept of an item
+// behind a thousand waiting ones, every operation is written to disk
+func BenchmarkQueue(b *testing.B) {
+	mlog.SetLevel(mlog.Linfo)
+	q, err := queue.NewQueueInDir(b.TempDir(), "bench")
+	if err != nil {
+		b.Fatalf("%v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		q.Enqueue(proto.QueuicItem{Id: uuid.New(), Item: make([]byte, 64)})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := q.Enqueue(proto.QueuicItem{Id: uuid.New(), Item: make([]byte, 64)}); err != nil {
+			b.Fatalf("failed to enqueue: %v", err)
+		}
+		item, err := q.Peek()
+		if err != nil {
+			b.Fatalf("failed to peek: %v", err)
+		}
+		if err := q.Accept(item.Id); err != nil {
+			b.Fatalf("failed to accept: %v", err)
+		}
+	}
+}
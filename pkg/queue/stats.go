@@ -0,0 +1,132 @@
+package queue
+
+import (
+	"time"
+
+	"github.com/dinifarb/queuic/pkg/proto"
+	"github.com/google/uuid"
+)
+
+const (
+	// the sliding windows of the stats are made of buckets of this length
+	STATS_BUCKET = 10 * time.Second
+	// longest window of the stats
+	STATS_WINDOW  = 5 * time.Minute
+	STATS_BUCKETS = int(STATS_WINDOW / STATS_BUCKET)
+)
+
+// window counts events and sums their durations over the last STATS_WINDOW
+type window struct {
+	buckets [STATS_BUCKETS]bucket
+}
+
+type bucket struct {
+	// slot is the index of the bucket since the unix epoch
+	slot  int64
+	count uint64
+	total time.Duration
+}
+
+func slotOf(t time.Time) int64 {
+	return t.UnixNano() / int64(STATS_BUCKET)
+}
+
+func (w *window) add(now time.Time, n int, d time.Duration) {
+	slot := slotOf(now)
+	b := &w.buckets[slot%int64(STATS_BUCKETS)]
+	if b.slot != slot {
+		*b = bucket{slot: slot}
+	}
+	b.count += uint64(n)
+	b.total += d
+}
+
+// sum returns the count and the total duration of the events in the
+// span before now, with span rounded up to whole buckets
+func (w *window) sum(now time.Time, span time.Duration) (uint64, time.Duration) {
+	slot := slotOf(now)
+	var count uint64
+	var total time.Duration
+	for i := int64(0); i < int64(span/STATS_BUCKET) && i < int64(STATS_BUCKETS); i++ {
+		b := w.buckets[(slot-i)%int64(STATS_BUCKETS)]
+		if b.slot == slot-i {
+			count += b.count
+			total += b.total
+		}
+	}
+	return count, total
+}
+
+// rate returns the events per second in the span before now
+func (w *window) rate(now time.Time, span time.Duration) float64 {
+	count, _ := w.sum(now, span)
+	// the current bucket is only filled up to now
+	buckets := span / STATS_BUCKET
+	elapsed := (buckets-1)*STATS_BUCKET + time.Duration(now.UnixNano()%int64(STATS_BUCKET))
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(count) / elapsed.Seconds()
+}
+
+// average returns the mean duration of the events in the span before now
+func (w *window) average(now time.Time, span time.Duration) time.Duration {
+	count, total := w.sum(now, span)
+	if count == 0 {
+		return 0
+	}
+	return total / time.Duration(count)
+}
+
+// stats are the sliding windows of a queue, guarded by the lock of the queue
+type stats struct {
+	enqueued window
+	dequeued window
+	// waited has the time from enqueue to peek of the peeked items
+	waited window
+	// processed has the time from peek to accept of the accepted items
+	processed window
+	peekedAt  map[uuid.UUID]time.Time
+}
+
+func (s *stats) enqueue(now time.Time, n int) {
+	s.enqueued.add(now, n, 0)
+}
+
+func (s *stats) peek(now time.Time, items []proto.QueuicItem) {
+	if s.peekedAt == nil {
+		s.peekedAt = make(map[uuid.UUID]time.Time)
+	}
+	var waited time.Duration
+	n := 0
+	for _, item := range items {
+		s.peekedAt[item.Id] = now
+		// items of files written before the timestamp was added have none
+		if !item.Timestamp.IsZero() {
+			waited += now.Sub(item.Timestamp)
+			n++
+		}
+	}
+	s.waited.add(now, n, waited)
+}
+
+func (s *stats) accept(now time.Time, items []proto.QueuicItem) {
+	var processed time.Duration
+	n := 0
+	for _, item := range items {
+		if peekedAt, ok := s.peekedAt[item.Id]; ok {
+			processed += now.Sub(peekedAt)
+			n++
+			delete(s.peekedAt, item.Id)
+		}
+	}
+	s.dequeued.add(now, len(items), 0)
+	s.processed.add(now, n, processed)
+}
+
+// forget drops the peek time of items which are no longer in flight
+func (s *stats) forget(items []proto.QueuicItem) {
+	for _, item := range items {
+		delete(s.peekedAt, item.Id)
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"crypto/sha256"
+	"sync"
+
+	"github.com/dinifarb/queuic/pkg/proto"
+)
+
+const (
+	RESPONSE_CACHE_SIZE = 1024
+)
+
+// responseCache remembers the responses of the latest requests, so a
+// request which is sent again because its response got lost is not
+// handled twice. Only requests with a request id are cached, they are
+// identified by the hash of their bytes. Errors are not cached, so a
+// request which failed is handled again when it is sent again.
+type responseCache struct {
+	mu      sync.Mutex
+	entries map[[32]byte]*cachedResponse
+	order   [][32]byte
+	size    int
+}
+
+type cachedResponse struct {
+	done chan struct{}
+	resp []byte
+}
+
+func newResponseCache(size int) *responseCache {
+	return &responseCache{
+		entries: make(map[[32]byte]*cachedResponse),
+		order:   make([][32]byte, 0, size),
+		size:    size,
+	}
+}
+
+// handle returns the cached response of the request or calls handler,
+// duplicates of a request which is still handled wait for its response
+func (c *responseCache) handle(req []byte, handler func() []byte) []byte {
+	if len(req) == 0 || req[0]&proto.REQUEST_ID_FLAG == 0 {
+		return handler()
+	}
+	key := sha256.Sum256(req)
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok {
+		c.mu.Unlock()
+		<-entry.done
+		return entry.resp
+	}
+	entry = &cachedResponse{done: make(chan struct{})}
+	c.entries[key] = entry
+	c.order = append(c.order, key)
+	if len(c.order) > c.size {
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.mu.Unlock()
+	entry.resp = handler()
+	close(entry.done)
+	if proto.PacketCommand(entry.resp) == proto.ERROR {
+		// the waiting duplicates get the error, later ones are handled
+		c.mu.Lock()
+		if c.entries[key] == entry {
+			delete(c.entries, key)
+			c.removeOrder(key)
+		}
+		c.mu.Unlock()
+	}
+	return entry.resp
+}
+
+// removeOrder removes the key from the eviction order, otherwise
+// it would evict a later entry of the key and count as an entry
+func (c *responseCache) removeOrder(key [32]byte) {
+	for i, k := range c.order {
+		if k == key {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dinifarb/queuic/pkg/proto"
+	"github.com/dinifarb/queuic/pkg/queue"
+)
+
+// the events of item operations are named like their queue.Op
+const (
+	EVENT_CREATE_QUEUE = "create_queue"
+	EVENT_DELETE_QUEUE = "delete_queue"
+	EVENT_DEAD_LETTER  = "dead_letter"
+	EVENT_MOVE         = "move"
+	// max count of ids of an event, Count has the total
+	MAX_EVENT_IDS = 100
+	// events of a subscriber which doesn't keep up are dropped
+	EVENT_BUFFER_SIZE = 256
+)
+
+// Event is a change of a queue or its items
+type Event struct {
+	Type  string `json:"type"`
+	Queue string `json:"queue"`
+	// Destination is the queue of a dead letter or move event
+	Destination string    `json:"destination,omitempty"`
+	Ids         []string  `json:"ids,omitempty"`
+	Count       int       `json:"count"`
+	Time        time.Time `json:"time"`
+}
+
+type Subscription struct {
+	Events  <-chan Event
+	events  chan Event
+	queues  map[proto.QueueName]struct{}
+	dropped uint64
+}
+
+// Dropped returns the count of events dropped because
+// the subscriber did not keep up
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+type eventBus struct {
+	mu          sync.RWMutex
+	subscribers map[*Subscription]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subscribers: make(map[*Subscription]struct{})}
+}
+
+// Subscribe returns a subscription to the events of the queues,
+// of all queues if none are given. It must be closed with Unsubscribe.
+func (s *QueuicServer) Subscribe(queues ...proto.QueueName) *Subscription {
+	events := make(chan Event, EVENT_BUFFER_SIZE)
+	sub := &Subscription{Events: events, events: events, queues: make(map[proto.QueueName]struct{})}
+	for _, q := range queues {
+		sub.queues[q] = struct{}{}
+	}
+	s.events.mu.Lock()
+	defer s.events.mu.Unlock()
+	s.events.subscribers[sub] = struct{}{}
+	return sub
+}
+
+func (s *QueuicServer) Unsubscribe(sub *Subscription) {
+	s.events.mu.Lock()
+	defer s.events.mu.Unlock()
+	if _, ok := s.events.subscribers[sub]; ok {
+		delete(s.events.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+func (b *eventBus) hasSubscribers() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.subscribers) > 0
+}
+
+// publish never blocks, it may be called with the lock of a queue held
+func (b *eventBus) publish(e Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for sub := range b.subscribers {
+		if len(sub.queues) > 0 {
+			_, source := sub.queues[proto.QueueName(e.Queue)]
+			_, destination := sub.queues[proto.QueueName(e.Destination)]
+			if !source && !destination {
+				continue
+			}
+		}
+		select {
+		case sub.events <- e:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+func (b *eventBus) publishItems(eventType string, name proto.QueueName, destination proto.QueueName, items []proto.QueuicItem) {
+	if !b.hasSubscribers() {
+		return
+	}
+	n := len(items)
+	if n > MAX_EVENT_IDS {
+		n = MAX_EVENT_IDS
+	}
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = items[i].Id.String()
+	}
+	b.publish(Event{
+		Type:        eventType,
+		Queue:       name.String(),
+		Destination: destination.String(),
+		Ids:         ids,
+		Count:       len(items),
+		Time:        time.Now(),
+	})
+}
+
+func (b *eventBus) publishQueue(eventType string, name proto.QueueName) {
+	if !b.hasSubscribers() {
+		return
+	}
+	b.publish(Event{Type: eventType, Queue: name.String(), Time: time.Now()})
+}
+
+// observe publishes the item operations of the queue
+func (s *QueuicServer) observe(q *queue.Queue) {
+	name := q.Name
+	q.SetObserver(func(op queue.Op, items []proto.QueuicItem) {
+		s.events.publishItems(string(op), name, "", items)
+	})
+}
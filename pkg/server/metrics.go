@@ -0,0 +1,191 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dinifarb/queuic/pkg/proto"
+)
+
+// upper bounds in seconds of the request latency buckets
+var LATENCY_BUCKETS = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+type histogram struct {
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(seconds float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range LATENCY_BUCKETS {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+type serverMetrics struct {
+	decryptFailures uint64
+	droppedPackets  uint64
+	rejectedPackets uint64
+	// workers is the size of the worker pool, busyWorkers
+	// the count of workers which handle a packet
+	workers     int64
+	busyWorkers int64
+	mu          sync.Mutex
+	latency     map[proto.Command]*histogram
+}
+
+func (m *serverMetrics) observeRequest(command proto.Command, d time.Duration) {
+	m.mu.Lock()
+	if m.latency == nil {
+		m.latency = make(map[proto.Command]*histogram)
+	}
+	h, ok := m.latency[command]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(LATENCY_BUCKETS))}
+		m.latency[command] = h
+	}
+	m.mu.Unlock()
+	h.observe(d.Seconds())
+}
+
+func (m *serverMetrics) decryptFailed() {
+	atomic.AddUint64(&m.decryptFailures, 1)
+	m.dropped()
+}
+
+func (m *serverMetrics) dropped() {
+	atomic.AddUint64(&m.droppedPackets, 1)
+}
+
+func (m *serverMetrics) rejected() {
+	atomic.AddUint64(&m.rejectedPackets, 1)
+}
+
+func (m *serverMetrics) setWorkers(workers int) {
+	atomic.StoreInt64(&m.workers, int64(workers))
+}
+
+func (m *serverMetrics) working(delta int64) {
+	atomic.AddInt64(&m.busyWorkers, delta)
+}
+
+// WriteMetrics writes the metrics of the server and its queues
+// in the Prometheus text format
+func (s *QueuicServer) WriteMetrics(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	s.writeQueueMetrics(b)
+	s.writeRequestMetrics(b)
+	writeMetricHeader(b, "queuic_decrypt_failures_total", "counter", "Packets which could not be decrypted.")
+	fmt.Fprintf(b, "queuic_decrypt_failures_total %d\n", atomic.LoadUint64(&s.metrics.decryptFailures))
+	writeMetricHeader(b, "queuic_dropped_packets_total", "counter", "Packets which were received or answered without success.")
+	fmt.Fprintf(b, "queuic_dropped_packets_total %d\n", atomic.LoadUint64(&s.metrics.droppedPackets))
+	s.writePoolMetrics(b)
+	return b.Flush()
+}
+
+func (s *QueuicServer) writePoolMetrics(b *bufio.Writer) {
+	s.mu.Lock()
+	backlog := s.backlog
+	s.mu.Unlock()
+	writeMetricHeader(b, "queuic_workers", "gauge", "Size of the worker pool which handles the requests.")
+	fmt.Fprintf(b, "queuic_workers %d\n", atomic.LoadInt64(&s.metrics.workers))
+	writeMetricHeader(b, "queuic_busy_workers", "gauge", "Workers which are handling a request.")
+	fmt.Fprintf(b, "queuic_busy_workers %d\n", atomic.LoadInt64(&s.metrics.busyWorkers))
+	writeMetricHeader(b, "queuic_backlog_length", "gauge", "Received requests which wait for a worker.")
+	fmt.Fprintf(b, "queuic_backlog_length %d\n", len(backlog))
+	writeMetricHeader(b, "queuic_backlog_capacity", "gauge", "Requests which can wait for a worker before they are rejected.")
+	fmt.Fprintf(b, "queuic_backlog_capacity %d\n", cap(backlog))
+	writeMetricHeader(b, "queuic_rejected_requests_total", "counter", "Requests which were answered with ERR_BUSY.")
+	fmt.Fprintf(b, "queuic_rejected_requests_total %d\n", atomic.LoadUint64(&s.metrics.rejectedPackets))
+}
+
+func (s *QueuicServer) writeQueueMetrics(w io.Writer) {
+	type sample struct {
+		name  proto.QueueName
+		value string
+	}
+	var depth, inFlight, enqueued, dequeued, released, age []sample
+	now := time.Now()
+	for _, name := range s.ListQueues() {
+		q, ok := s.getQueue(name)
+		if !ok {
+			continue
+		}
+		m := q.Metrics()
+		oldest := 0.0
+		if !m.Oldest.IsZero() {
+			oldest = now.Sub(m.Oldest).Seconds()
+		}
+		depth = append(depth, sample{name, strconv.Itoa(m.Waiting)})
+		inFlight = append(inFlight, sample{name, strconv.Itoa(m.InFlight)})
+		enqueued = append(enqueued, sample{name, strconv.FormatUint(m.Enqueued, 10)})
+		dequeued = append(dequeued, sample{name, strconv.FormatUint(m.Dequeued, 10)})
+		released = append(released, sample{name, strconv.FormatUint(m.Released, 10)})
+		age = append(age, sample{name, formatFloat(oldest)})
+	}
+	families := []struct {
+		name, kind, help string
+		samples          []sample
+	}{
+		{"queuic_queue_depth", "gauge", "Items waiting in the queue.", depth},
+		{"queuic_queue_in_flight", "gauge", "Items peeked and not yet accepted or released.", inFlight},
+		{"queuic_queue_enqueued_total", "counter", "Items enqueued to the queue.", enqueued},
+		{"queuic_queue_dequeued_total", "counter", "Items accepted from the queue.", dequeued},
+		{"queuic_queue_released_total", "counter", "Items released back to the queue.", released},
+		{"queuic_queue_oldest_message_age_seconds", "gauge", "Age of the oldest waiting item.", age},
+	}
+	for _, f := range families {
+		writeMetricHeader(w, f.name, f.kind, f.help)
+		for _, s := range f.samples {
+			fmt.Fprintf(w, "%s{queue=%q} %s\n", f.name, s.name, s.value)
+		}
+	}
+}
+
+func (s *QueuicServer) writeRequestMetrics(w io.Writer) {
+	const name = "queuic_request_duration_seconds"
+	writeMetricHeader(w, name, "histogram", "Time to handle a request by command.")
+	s.metrics.mu.Lock()
+	commands := make([]proto.Command, 0, len(s.metrics.latency))
+	for c := range s.metrics.latency {
+		commands = append(commands, c)
+	}
+	s.metrics.mu.Unlock()
+	sort.Slice(commands, func(i, j int) bool {
+		return commands[i] < commands[j]
+	})
+	for _, c := range commands {
+		s.metrics.mu.Lock()
+		h := s.metrics.latency[c]
+		s.metrics.mu.Unlock()
+		h.mu.Lock()
+		for i, bound := range LATENCY_BUCKETS {
+			fmt.Fprintf(w, "%s_bucket{command=%q,le=%q} %d\n", name, c.String(), formatFloat(bound), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{command=%q,le=\"+Inf\"} %d\n", name, c.String(), h.count)
+		fmt.Fprintf(w, "%s_sum{command=%q} %s\n", name, c.String(), formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count{command=%q} %d\n", name, c.String(), h.count)
+		h.mu.Unlock()
+	}
+}
+
+func writeMetricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
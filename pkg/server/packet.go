@@ -1,7 +1,10 @@
 package server
 
 import (
+	"context"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 
 	"github.com/dinifarb/mlog"
@@ -11,35 +14,95 @@ import (
 )
 
 func (s *QueuicServer) HandleQueuicRequest(b []byte) ([]byte, error) {
+	return s.handleRequest(context.Background(), b)
+}
+
+// handleRequest handles the request with the trace context of ctx
+func (s *QueuicServer) handleRequest(ctx context.Context, b []byte) ([]byte, error) {
 	req, err := proto.Decode(b)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode request: %v", err)
+		return nil, fmt.Errorf("%w: failed to decode request: %v", ErrBadRequest, err)
+	}
+	switch req.Command {
+	case proto.CREATE_QUEUE:
+		return s.handleCreateQueue(req)
+	case proto.DELETE_QUEUE:
+		return s.handleDeleteQueue(req)
+	case proto.LIST_QUEUES:
+		return s.handleListQueues(req)
+	case proto.STATS:
+		return s.handleStats(req)
+	case proto.PURGE:
+		return s.handlePurge(req)
+	case proto.BROWSE:
+		return s.handleBrowse(req)
+	case proto.MOVE:
+		return s.handleMove(req)
+	}
+	queue, ok := s.getQueue(req.QueueName)
+	if !ok && (req.Command == proto.ENQUEUE || req.Command == proto.ENQUEUE_BATCH) {
+		queue, ok = s.autoCreateQueue(req.QueueName)
 	}
-	queue, ok := s.queueStore.queues[req.QueueName]
 	if !ok {
-		//TODO: handle create queue on the fly
-		return nil, fmt.Errorf("queue %s does not exists", req.QueueName)
+		return nil, fmt.Errorf("%w: %s", ErrQueueNotFound, req.QueueName)
 	}
+	if req.Command == proto.SIZE {
+		return handleSize(queue, req)
+	}
+	// the queue writes every change to disk before it returns,
+	// so the time of the queue operation is the time to persist
+	_, span := s.Tracer.Start(ctx, "persist")
+	defer span.End()
+	span.SetAttribute("queuic.queue", req.QueueName.String())
+	resp, err := handleItemRequest(queue, req)
+	span.SetError(err)
+	return resp, err
+}
+
+// handleItemRequest handles the commands which change the items of a queue
+func handleItemRequest(current_queue *queue.Queue, req *proto.Queuic) ([]byte, error) {
 	switch req.Command {
 	case proto.ENQUEUE:
-		return handleEnqueue(queue, req)
+		return handleEnqueue(current_queue, req)
 	case proto.PEEK:
-		return handlePeek(queue, req)
+		return handlePeek(current_queue, req)
 	case proto.ACCEPT:
-		return handleAccept(queue, req)
+		return handleAccept(current_queue, req)
 	case proto.RELEASE:
-		return handleRelease(queue, req)
-	case proto.SIZE:
-		return handleSize(queue, req)
+		return handleRelease(current_queue, req)
+	case proto.ENQUEUE_BATCH:
+		return handleEnqueueBatch(current_queue, req)
+	case proto.PEEK_BATCH:
+		return handlePeekBatch(current_queue, req)
+	case proto.ACCEPT_BATCH:
+		return handleAcceptBatch(current_queue, req)
+	case proto.RELEASE_BATCH:
+		return handleReleaseBatch(current_queue, req)
 	default:
-		return nil, fmt.Errorf("unknown command: %v", req.Command)
+		return nil, fmt.Errorf("%w: unknown command: %v", ErrBadRequest, req.Command)
+	}
+}
+
+// checkItem rejects an item without id, the id identifies it in flight and
+// to drop duplicates. It also rejects an item which would not fit in the
+// response when it is peeked, a peeked item needs more bytes than an enqueued one.
+func checkItem(item proto.QueuicItem) error {
+	if item.Id == uuid.Nil {
+		return fmt.Errorf("%w: item id must not be nil", ErrBadRequest)
 	}
+	if proto.BatchItemLength(item) > MAX_BATCH_BYTES {
+		return fmt.Errorf("%w: item of %d bytes does not fit in a packet", ErrBadRequest, len(item.Item))
+	}
+	return nil
 }
 
 func handleEnqueue(current_queue *queue.Queue, q *proto.Queuic) ([]byte, error) {
+	if err := checkItem(q.QueuicItem); err != nil {
+		return nil, err
+	}
 	err := current_queue.Enqueue(q.QueuicItem)
 	if err != nil {
-		return nil, fmt.Errorf("failed to enqueue: %v", err)
+		return nil, fmt.Errorf("failed to enqueue: %w", err)
 	}
 	mlog.Debug("enqueued item: %v", q.QueuicItem.Id)
 	ack := proto.Queuic{
@@ -52,7 +115,7 @@ func handleEnqueue(current_queue *queue.Queue, q *proto.Queuic) ([]byte, error)
 func handlePeek(current_queue *queue.Queue, q *proto.Queuic) ([]byte, error) {
 	queueItem, err := current_queue.Peek()
 	if err != nil {
-		return nil, fmt.Errorf("failed to peek: %v", err)
+		return nil, fmt.Errorf("failed to peek: %w", err)
 	}
 	mlog.Debug("peeked item: %v", queueItem.Id)
 	ack := proto.Queuic{
@@ -64,9 +127,12 @@ func handlePeek(current_queue *queue.Queue, q *proto.Queuic) ([]byte, error) {
 }
 
 func handleAccept(current_queue *queue.Queue, q *proto.Queuic) ([]byte, error) {
+	if err := checkInFlight(current_queue, q.QueuicItem.Id); err != nil {
+		return nil, err
+	}
 	err := current_queue.Accept(q.QueuicItem.Id)
 	if err != nil {
-		return nil, fmt.Errorf("failed to accept: %v", err)
+		return nil, fmt.Errorf("failed to accept: %w", err)
 	}
 	mlog.Debug("accepted item: %v", q.QueuicItem.Id)
 	ack := proto.Queuic{
@@ -77,12 +143,16 @@ func handleAccept(current_queue *queue.Queue, q *proto.Queuic) ([]byte, error) {
 }
 
 func handleRelease(current_queue *queue.Queue, q *proto.Queuic) ([]byte, error) {
+	if err := checkInFlight(current_queue, q.QueuicItem.Id); err != nil {
+		return nil, err
+	}
 	err := current_queue.Release(q.QueuicItem.Id)
 	if err != nil {
-		return nil, fmt.Errorf("failed to release: %v", err)
+		return nil, fmt.Errorf("failed to release: %w", err)
 	}
+	mlog.Debug("released item: %v", q.QueuicItem.Id)
 	ack := proto.Queuic{
-		Command:   proto.ACCEPT_ACK,
+		Command:   proto.RELEASE_ACK,
 		QueueName: q.QueueName,
 	}
 	return encodeResponse(&ack)
@@ -104,6 +174,273 @@ func handleSize(current_queue *queue.Queue, q *proto.Queuic) ([]byte, error) {
 	return encodeResponse(&ack)
 }
 
+func handleEnqueueBatch(current_queue *queue.Queue, q *proto.Queuic) ([]byte, error) {
+	if len(q.Items) == 0 {
+		return nil, fmt.Errorf("%w: empty batch", ErrBadRequest)
+	}
+	for _, item := range q.Items {
+		if err := checkItem(item); err != nil {
+			return nil, err
+		}
+	}
+	err := current_queue.EnqueueBatch(q.Items)
+	if err != nil {
+		return nil, fmt.Errorf("failed to enqueue batch: %w", err)
+	}
+	mlog.Debug("enqueued batch of %d items", len(q.Items))
+	ack := proto.Queuic{
+		Command:   proto.ENQUEUE_BATCH_ACK,
+		QueueName: q.QueueName,
+	}
+	return encodeResponse(&ack)
+}
+
+// the max count of items to peek is sent as uint16 in the item
+func handlePeekBatch(current_queue *queue.Queue, q *proto.Queuic) ([]byte, error) {
+	if len(q.QueuicItem.Item) < 2 {
+		return nil, fmt.Errorf("%w: peek batch is missing the item count", ErrBadRequest)
+	}
+	max := int(binary.LittleEndian.Uint16(q.QueuicItem.Item))
+	if max == 0 {
+		return nil, fmt.Errorf("%w: peek batch count must be greater than 0", ErrBadRequest)
+	}
+	items, err := current_queue.PeekBatch(max, MAX_BATCH_BYTES)
+	if err != nil {
+		return nil, fmt.Errorf("failed to peek batch: %w", err)
+	}
+	mlog.Debug("peeked batch of %d items", len(items))
+	ack := proto.Queuic{
+		Command:   proto.PEEK_BATCH_ACK,
+		QueueName: q.QueueName,
+		Items:     items,
+	}
+	return encodeResponse(&ack)
+}
+
+func handleAcceptBatch(current_queue *queue.Queue, q *proto.Queuic) ([]byte, error) {
+	if err := checkInFlight(current_queue, itemIds(q.Items)...); err != nil {
+		return nil, err
+	}
+	err := current_queue.AcceptBatch(itemIds(q.Items))
+	if err != nil {
+		return nil, fmt.Errorf("failed to accept batch: %w", err)
+	}
+	mlog.Debug("accepted batch of %d items", len(q.Items))
+	ack := proto.Queuic{
+		Command:   proto.ACCEPT_BATCH_ACK,
+		QueueName: q.QueueName,
+	}
+	return encodeResponse(&ack)
+}
+
+func handleReleaseBatch(current_queue *queue.Queue, q *proto.Queuic) ([]byte, error) {
+	if err := checkInFlight(current_queue, itemIds(q.Items)...); err != nil {
+		return nil, err
+	}
+	err := current_queue.ReleaseBatch(itemIds(q.Items))
+	if err != nil {
+		return nil, fmt.Errorf("failed to release batch: %w", err)
+	}
+	mlog.Debug("released batch of %d items", len(q.Items))
+	ack := proto.Queuic{
+		Command:   proto.RELEASE_BATCH_ACK,
+		QueueName: q.QueueName,
+	}
+	return encodeResponse(&ack)
+}
+
+func (s *QueuicServer) handleCreateQueue(q *proto.Queuic) ([]byte, error) {
+	if err := s.CreateQueue(q.QueueName); err != nil {
+		return nil, err
+	}
+	ack := proto.Queuic{
+		Command:   proto.CREATE_QUEUE_ACK,
+		QueueName: q.QueueName,
+	}
+	return encodeResponse(&ack)
+}
+
+func (s *QueuicServer) handleDeleteQueue(q *proto.Queuic) ([]byte, error) {
+	if err := s.DeleteQueue(q.QueueName); err != nil {
+		return nil, err
+	}
+	ack := proto.Queuic{
+		Command:   proto.DELETE_QUEUE_ACK,
+		QueueName: q.QueueName,
+	}
+	return encodeResponse(&ack)
+}
+
+// pageOffset returns the offset of a paged request, it is sent as
+// little endian uint32 in the item and 0 if the item is empty
+func pageOffset(q *proto.Queuic) int {
+	if len(q.QueuicItem.Item) < 4 {
+		return 0
+	}
+	return int(binary.LittleEndian.Uint32(q.QueuicItem.Item))
+}
+
+// the names from the offset of the request are sent as items of a batch,
+// as many as fit in a packet. An empty batch is the end of the names.
+func (s *QueuicServer) handleListQueues(q *proto.Queuic) ([]byte, error) {
+	names := s.ListQueues()
+	items := make([]proto.QueuicItem, 0)
+	size := 0
+	for i := pageOffset(q); i < len(names); i++ {
+		item := proto.QueuicItem{Item: []byte(names[i].String())}
+		size += proto.BatchItemLength(item)
+		if size > MAX_BATCH_BYTES {
+			break
+		}
+		items = append(items, item)
+	}
+	ack := proto.Queuic{
+		Command: proto.LIST_QUEUES_ACK,
+		Items:   items,
+	}
+	return encodeResponse(&ack)
+}
+
+// the stats are sent as json in the item. Without queue name the
+// stats of all queues from the offset of the request are sent, as
+// many as fit in a packet. An empty list is the end of the queues.
+func (s *QueuicServer) handleStats(q *proto.Queuic) ([]byte, error) {
+	var stats []QueueStats
+	if q.QueueName == "" {
+		stats = s.GetStats()
+		if offset := pageOffset(q); offset < len(stats) {
+			stats = stats[offset:]
+		} else {
+			stats = stats[:0]
+		}
+	} else {
+		queueStats, err := s.GetQueueStats(q.QueueName)
+		if err != nil {
+			return nil, err
+		}
+		stats = []QueueStats{queueStats}
+	}
+	for {
+		b, err := json.Marshal(stats)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal stats: %v", err)
+		}
+		if len(b) > MAX_BATCH_BYTES && len(stats) > 1 {
+			stats = stats[:len(stats)/2]
+			continue
+		}
+		ack := proto.Queuic{
+			Command:   proto.STATS_ACK,
+			QueueName: q.QueueName,
+			QueuicItem: proto.QueuicItem{
+				Id:   uuid.New(),
+				Item: b,
+			},
+		}
+		return encodeResponse(&ack)
+	}
+}
+
+// the item of a PURGE request is empty or a byte which is 1 to purge
+// the in flight items too, the count of purged items is sent as uint64 in the item
+func (s *QueuicServer) handlePurge(q *proto.Queuic) ([]byte, error) {
+	inFlight := len(q.QueuicItem.Item) > 0 && q.QueuicItem.Item[0] == 1
+	n, err := s.PurgeQueue(q.QueueName, inFlight)
+	if err != nil {
+		return nil, err
+	}
+	countBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(countBytes, uint64(n))
+	ack := proto.Queuic{
+		Command:   proto.PURGE_ACK,
+		QueueName: q.QueueName,
+		QueuicItem: proto.QueuicItem{
+			Id:   uuid.New(),
+			Item: countBytes,
+		},
+	}
+	return encodeResponse(&ack)
+}
+
+// checkInFlight fails if one of the items is not in flight, like
+// an unknown or already accepted item, and nothing is accepted or released
+func checkInFlight(current_queue *queue.Queue, ids ...uuid.UUID) error {
+	for _, id := range ids {
+		if !current_queue.InFlight(id) {
+			return fmt.Errorf("%w: %v", ErrItemNotFound, id)
+		}
+	}
+	return nil
+}
+
+func itemIds(items []proto.QueuicItem) []uuid.UUID {
+	ids := make([]uuid.UUID, len(items))
+	for i, item := range items {
+		ids[i] = item.Id
+	}
+	return ids
+}
+
+const (
+	MAX_ERROR_MESSAGE_LENGTH = 1024
+)
+
+// errorResponse builds the ERROR response for a failed request,
+// it echoes the queue name and item id of the request if possible
+func errorResponse(req []byte, err error) []byte {
+	message := err.Error()
+	if len(message) > MAX_ERROR_MESSAGE_LENGTH {
+		message = message[:MAX_ERROR_MESSAGE_LENGTH]
+	}
+	resp := proto.Queuic{
+		Command: proto.ERROR,
+		QueuicItem: proto.QueuicItem{
+			Item: proto.EncodeError(errorCode(err), message),
+		},
+	}
+	if q, decodeErr := proto.Decode(req); decodeErr == nil {
+		resp.QueueName = q.QueueName
+		resp.QueuicItem.Id = q.QueuicItem.Id
+	}
+	b, err := proto.Encode(&resp)
+	if err != nil {
+		mlog.Error("failed to encode error response: %v", err)
+		return nil
+	}
+	return b
+}
+
+func errorCode(err error) proto.ErrorCode {
+	switch {
+	case errors.Is(err, ErrBadRequest):
+		return proto.ERR_BAD_REQUEST
+	case errors.Is(err, ErrQueueNotFound), errors.Is(err, queue.ErrClosed):
+		// a closed queue was deleted while the request was handled
+		return proto.ERR_QUEUE_NOT_FOUND
+	case errors.Is(err, ErrQueueExists):
+		return proto.ERR_QUEUE_EXISTS
+	case errors.Is(err, queue.ErrEmpty):
+		return proto.ERR_QUEUE_EMPTY
+	case errors.Is(err, queue.ErrFull):
+		return proto.ERR_QUEUE_FULL
+	case errors.Is(err, ErrBusy):
+		return proto.ERR_BUSY
+	case errors.Is(err, ErrItemNotFound):
+		return proto.ERR_ITEM_NOT_FOUND
+	default:
+		return proto.ERR_INTERNAL
+	}
+}
+
+// an empty queue is the normal case for polling consumers
+func logRequestError(err error) {
+	if errors.Is(err, queue.ErrEmpty) {
+		mlog.Debug("error handling request: %v", err)
+		return
+	}
+	mlog.Error("error handling request: %v", err)
+}
+
 func encodeResponse(q *proto.Queuic) ([]byte, error) {
 	b, err := proto.Encode(q)
 	if err != nil {
@@ -111,3 +448,64 @@ func encodeResponse(q *proto.Queuic) ([]byte, error) {
 	}
 	return b, nil
 }
+
+// the item of a MOVE request is a json MoveRequest,
+// the count of moved items is sent as uint64 in the item
+func (s *QueuicServer) handleMove(q *proto.Queuic) ([]byte, error) {
+	var req MoveRequest
+	if err := json.Unmarshal(q.QueuicItem.Item, &req); err != nil {
+		return nil, fmt.Errorf("%w: invalid move request: %v", ErrBadRequest, err)
+	}
+	n, err := s.MoveItems(q.QueueName, req.Destination, req.MoveFilter)
+	if err != nil {
+		return nil, err
+	}
+	countBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(countBytes, uint64(n))
+	ack := proto.Queuic{
+		Command:   proto.MOVE_ACK,
+		QueueName: q.QueueName,
+		QueuicItem: proto.QueuicItem{
+			Id:   uuid.New(),
+			Item: countBytes,
+		},
+	}
+	return encodeResponse(&ack)
+}
+
+// the item of a BROWSE request is the offset as uint32 and the
+// limit as uint16, the BROWSE_ACK carries the page as json. The page
+// is cut to fit in a packet, the client continues at offset+len(items).
+func (s *QueuicServer) handleBrowse(q *proto.Queuic) ([]byte, error) {
+	if len(q.QueuicItem.Item) < 6 {
+		return nil, fmt.Errorf("%w: browse needs offset and limit", ErrBadRequest)
+	}
+	offset := int(binary.LittleEndian.Uint32(q.QueuicItem.Item))
+	limit := int(binary.LittleEndian.Uint16(q.QueuicItem.Item[4:]))
+	page, err := s.Browse(q.QueueName, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		b, err := json.Marshal(page)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal page: %v", err)
+		}
+		if len(b) > MAX_BATCH_BYTES {
+			if len(page.Items) <= 1 {
+				return nil, fmt.Errorf("item at offset %d does not fit in a packet", offset)
+			}
+			page.Items = page.Items[:len(page.Items)/2]
+			continue
+		}
+		ack := proto.Queuic{
+			Command:   proto.BROWSE_ACK,
+			QueueName: q.QueueName,
+			QueuicItem: proto.QueuicItem{
+				Id:   uuid.New(),
+				Item: b,
+			},
+		}
+		return encodeResponse(&ack)
+	}
+}
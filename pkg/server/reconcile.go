@@ -0,0 +1,110 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/dinifarb/mlog"
+	"github.com/dinifarb/queuic/pkg/proto"
+	"github.com/dinifarb/queuic/pkg/queue"
+)
+
+// QueueDefinition declares a queue which ReconcileQueues
+// creates or updates to the given options
+type QueueDefinition struct {
+	Name    proto.QueueName
+	Options queue.Options
+}
+
+// ReconcileQueues creates the missing queues of the Queues definitions and
+// updates the options of the existing ones. Queues which are not defined are
+// kept and logged as unmanaged. The first error is returned after all
+// definitions are applied.
+func (s *QueuicServer) ReconcileQueues() error {
+	s.settings.RLock()
+	definitions := s.Queues
+	s.settings.RUnlock()
+	var first error
+	defined := make(map[proto.QueueName]bool, len(definitions))
+	for _, def := range definitions {
+		defined[def.Name] = true
+		if err := s.reconcileQueue(def); err != nil {
+			mlog.Error("failed to reconcile queue %s: %v", def.Name, err)
+			if first == nil {
+				first = fmt.Errorf("failed to reconcile queue %s: %w", def.Name, err)
+			}
+		}
+	}
+	if len(definitions) == 0 {
+		return first
+	}
+	for _, name := range s.ListQueues() {
+		if !defined[name] {
+			mlog.Warn("queue %s is not defined in the config", name)
+		}
+	}
+	return first
+}
+
+func (s *QueuicServer) reconcileQueue(def QueueDefinition) error {
+	if err := def.Name.Validate(); err != nil {
+		return fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+	s.queueStore.Lock()
+	q, ok := s.queueStore.queues[def.Name]
+	if !ok {
+		_, err := s.createQueue(def.Name, def.Options)
+		s.queueStore.Unlock()
+		return err
+	}
+	s.queueStore.Unlock()
+	if q.Options() == def.Options {
+		return nil
+	}
+	if err := def.Options.Validate(def.Name); err != nil {
+		return fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+	s.setQueueOptions(q, def.Options)
+	mlog.Info("updated options of queue %s to the definition", def.Name)
+	return nil
+}
+
+// definedOptions returns the options of the definition of the queue
+func (s *QueuicServer) definedOptions(name proto.QueueName) (queue.Options, bool) {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
+	for _, def := range s.Queues {
+		if def.Name == name {
+			return def.Options, true
+		}
+	}
+	return queue.Options{}, false
+}
+
+// Settings are the settings of the server which Reload replaces
+type Settings struct {
+	// Key replaces the key if not empty
+	Key            string
+	Queues         []QueueDefinition
+	DefaultOptions queue.Options
+	AutoCreate     []AutoCreateRule
+}
+
+// Reload replaces the settings while the server is serving and
+// reconciles the queues. The queues keep their items, peeked
+// items stay in flight and can be accepted after the reload.
+func (s *QueuicServer) Reload(settings Settings) error {
+	s.settings.Lock()
+	if settings.Key != "" {
+		key := sha256.Sum256([]byte(settings.Key))
+		if key != s.Key {
+			mlog.Info("replaced the server key")
+		}
+		s.Key = key
+	}
+	s.Queues = settings.Queues
+	s.DefaultOptions = settings.DefaultOptions
+	s.AutoCreate = settings.AutoCreate
+	s.settings.Unlock()
+	return s.ReconcileQueues()
+}
@@ -1,16 +1,22 @@
 package server
 
 import (
+	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"path"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/dinifarb/mlog"
 	"github.com/dinifarb/queuic/pkg/proto"
 	"github.com/dinifarb/queuic/pkg/queue"
+	"github.com/dinifarb/queuic/pkg/trace"
 	"github.com/google/uuid"
 )
 
@@ -18,13 +24,79 @@ const (
 	NETWORK_TYPE      = "udp"
 	MAX_PACKET_LENGTH = 4096
 	DEFAULT_PORT      = 9523
+	// nonce and tag added by the encryption
+	CRYPTO_OVERHEAD = 28
+	// max bytes of items in a PEEK_BATCH_ACK so that it still fits in a packet
+	MAX_BATCH_BYTES = MAX_PACKET_LENGTH - CRYPTO_OVERHEAD - proto.MAX_HEADER_LENGTH - 2
+	// max count of items of a browsed page
+	MAX_BROWSE_LIMIT = 1000
+	// goroutines which handle the received packets
+	DEFAULT_WORKERS = 64
+	// received packets which wait for a worker, more are answered with ERR_BUSY
+	DEFAULT_BACKLOG = 1024
+)
+
+var (
+	ErrQueueNotFound = errors.New("queue does not exist")
+	ErrQueueExists   = errors.New("queue already exists")
+	ErrItemNotFound  = errors.New("item is not in flight")
+	ErrBadRequest    = errors.New("bad request")
+	ErrServerClosed  = errors.New("server is shut down")
+	ErrBusy          = errors.New("server is busy")
 )
 
 type QueuicServer struct {
-	Port       int
-	Key        [32]byte
-	shutdown   chan bool
+	Port int
+	// BindAddress is the ip to receive on, all interfaces if empty
+	BindAddress string
+	// DataDir has the queue files, DEFAULT_DATA_DIR if empty
+	DataDir string
+	// Workers handle the received packets, DEFAULT_WORKERS if 0
+	Workers int
+	// Backlog is the count of packets which wait for a worker,
+	// DEFAULT_BACKLOG if 0. Packets which don't fit are answered
+	// with ERR_BUSY, so a burst can't exhaust the memory.
+	Backlog int
+	// Key, Queues, DefaultOptions and AutoCreate must
+	// not be changed while serving, use Reload instead
+	Key [32]byte
+	// Queues are the declared queues, see ReconcileQueues
+	Queues []QueueDefinition
+	// DefaultOptions are the options of the queues which are created
+	// without options, aren't declared and don't match an AutoCreate rule
+	DefaultOptions queue.Options
+	// AutoCreate lets an ENQUEUE to an unknown queue create it,
+	// if its name matches one of the rules
+	AutoCreate []AutoCreateRule
+	// Tracer records the spans of the requests, nil disables tracing
+	Tracer *trace.Tracer
+	// settings guards the fields which Reload changes
+	settings   sync.RWMutex
 	queueStore QueueStore
+	responses  *responseCache
+	events     *eventBus
+	metrics    serverMetrics
+	// closing is closed by Shutdown, served when Serve returned
+	mu       sync.Mutex
+	closing  chan struct{}
+	served   chan struct{}
+	conn     *net.UDPConn
+	backlog  chan packet
+	handlers sync.WaitGroup
+}
+
+// packet is a received packet which waits for a worker
+type packet struct {
+	buff       []byte
+	remoteAddr *net.UDPAddr
+	received   time.Time
+}
+
+// AutoCreateRule matches queue names with a pattern as
+// supported by path.Match, e.g. "tenant-*"
+type AutoCreateRule struct {
+	Pattern string
+	Options queue.Options
 }
 
 type QueueStore struct {
@@ -37,6 +109,17 @@ type QueueStats struct {
 	Size      int    `json:"size"`
 	Enequeued uint64 `json:"enequeued"`
 	Dequeued  uint64 `json:"dequeued"`
+	// the rates are items per second over the last minute or five minutes
+	EnqueueRate1m float64 `json:"enqueue_rate_1m"`
+	EnqueueRate5m float64 `json:"enqueue_rate_5m"`
+	DequeueRate1m float64 `json:"dequeue_rate_1m"`
+	DequeueRate5m float64 `json:"dequeue_rate_5m"`
+	// OldestAge is the age of the first waiting item, 0 if none is waiting
+	OldestAge float64 `json:"oldest_age_seconds"`
+	// AvgTimeInQueue is the mean time from enqueue to peek and
+	// AvgProcessing the mean time from peek to accept over five minutes
+	AvgTimeInQueue float64 `json:"avg_time_in_queue_seconds"`
+	AvgProcessing  float64 `json:"avg_processing_seconds"`
 }
 
 func NewQueuicServer(key string) *QueuicServer {
@@ -46,86 +129,381 @@ func NewQueuicServer(key string) *QueuicServer {
 	return &QueuicServer{
 		Key:        k,
 		queueStore: QueueStore{queues: q},
+		responses:  newResponseCache(RESPONSE_CACHE_SIZE),
+		events:     newEventBus(),
+		closing:    make(chan struct{}),
 	}
 }
 
+// CreateQueue creates a queue with the options of its definition,
+// of the AutoCreate rule which matches its name or the DefaultOptions
 func (s *QueuicServer) CreateQueue(name proto.QueueName) error {
+	return s.CreateQueueWithOptions(name, s.defaultOptions(name))
+}
+
+func (s *QueuicServer) CreateQueueWithOptions(name proto.QueueName, options queue.Options) error {
+	if err := name.Validate(); err != nil {
+		return fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
 	s.queueStore.Lock()
 	defer s.queueStore.Unlock()
 	for _, q := range s.queueStore.queues {
 		if q.Name == name {
-			return fmt.Errorf("queue %s already exists", name)
+			return fmt.Errorf("%w: %s", ErrQueueExists, name)
 		}
 	}
-	q, err := queue.NewQueue(name)
+	_, err := s.createQueue(name, options)
+	return err
+}
+
+// createQueue expects the store to be locked
+func (s *QueuicServer) createQueue(name proto.QueueName, options queue.Options) (*queue.Queue, error) {
+	if err := options.Validate(name); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+	q, err := queue.NewQueueInDir(s.dataDir(), name)
 	if err != nil {
-		return fmt.Errorf("failed to create queue: %v", err)
+		return nil, fmt.Errorf("failed to create queue: %v", err)
 	}
+	s.setQueueOptions(q, options)
+	s.observe(q)
 	s.queueStore.queues[name] = q
 	mlog.Info("created queue: %s", name)
+	s.events.publishQueue(EVENT_CREATE_QUEUE, name)
+	return q, nil
+}
+
+func (s *QueuicServer) setQueueOptions(q *queue.Queue, options queue.Options) {
+	q.SetOptions(options)
+	if options.DeadLetter == "" {
+		q.SetExpiredHandler(nil)
+		return
+	}
+	source, deadLetter := q.Name, options.DeadLetter
+	q.SetExpiredHandler(func(items []proto.QueuicItem) error {
+		return s.deadLetter(source, deadLetter, items)
+	})
+}
+
+// deadLetter moves the expired items to the dead letter queue,
+// the source keeps them if they can not be moved
+func (s *QueuicServer) deadLetter(source proto.QueueName, name proto.QueueName, items []proto.QueuicItem) error {
+	q, ok := s.getQueue(name)
+	if !ok {
+		q, ok = s.autoCreateQueue(name)
+	}
+	if !ok {
+		return fmt.Errorf("%w: dead letter queue %s", ErrQueueNotFound, name)
+	}
+	if err := q.Requeue(items); err != nil {
+		return fmt.Errorf("failed to move to dead letter queue %s: %w", name, err)
+	}
+	mlog.Debug("moved %d expired items from queue %s to %s", len(items), source, name)
+	s.events.publishItems(EVENT_DEAD_LETTER, source, name, items)
 	return nil
 }
 
+// autoCreateQueue creates the queue if its name matches an auto create rule
+func (s *QueuicServer) autoCreateQueue(name proto.QueueName) (*queue.Queue, bool) {
+	options, ok := s.autoCreateOptions(name)
+	if !ok {
+		return nil, false
+	}
+	s.queueStore.Lock()
+	defer s.queueStore.Unlock()
+	if q, ok := s.queueStore.queues[name]; ok {
+		return q, true
+	}
+	q, err := s.createQueue(name, options)
+	if err != nil {
+		mlog.Error("failed to auto create queue %s: %v", name, err)
+		return nil, false
+	}
+	return q, true
+}
+
+func (s *QueuicServer) autoCreateOptions(name proto.QueueName) (queue.Options, bool) {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
+	for _, rule := range s.AutoCreate {
+		if ok, _ := path.Match(rule.Pattern, name.String()); ok {
+			return rule.Options, true
+		}
+	}
+	return queue.Options{}, false
+}
+
+// defaultOptions returns the options of a queue created without options
+func (s *QueuicServer) defaultOptions(name proto.QueueName) queue.Options {
+	if options, ok := s.definedOptions(name); ok {
+		return options
+	}
+	if options, ok := s.autoCreateOptions(name); ok {
+		return options
+	}
+	s.settings.RLock()
+	defer s.settings.RUnlock()
+	options := s.DefaultOptions
+	// the dead letter queue of the defaults keeps its expired items
+	if options.DeadLetter == name {
+		options.DeadLetter = ""
+	}
+	return options
+}
+
+func (s *QueuicServer) dataDir() string {
+	if s.DataDir == "" {
+		return queue.DEFAULT_DATA_DIR
+	}
+	return s.DataDir
+}
+
 func (s *QueuicServer) DeleteQueue(name proto.QueueName) error {
 	s.queueStore.Lock()
 	defer s.queueStore.Unlock()
 	q, ok := s.queueStore.queues[name]
 	if !ok {
-		return fmt.Errorf("queue %s does not exist", name)
+		return fmt.Errorf("%w: %s", ErrQueueNotFound, name)
 	}
 	if err := q.Delete(); err != nil {
 		return fmt.Errorf("failed to delete queue: %v", err)
 	}
 	delete(s.queueStore.queues, name)
 	mlog.Info("deleted queue: %s", name)
+	s.events.publishQueue(EVENT_DELETE_QUEUE, name)
 	return nil
 }
 
-func (s *QueuicServer) Enqueue(queue proto.QueueName, item []byte) error {
-	s.queueStore.Lock()
-	defer s.queueStore.Unlock()
-	q, ok := s.queueStore.queues[queue]
+func (s *QueuicServer) Enqueue(queue proto.QueueName, item []byte, headers map[string]string) (uuid.UUID, error) {
+	q, ok := s.getQueue(queue)
 	if !ok {
-		return fmt.Errorf("queue %s does not exist", queue)
+		return uuid.Nil, fmt.Errorf("%w: %s", ErrQueueNotFound, queue)
+	}
+	if err := proto.ValidateHeaders(headers); err != nil {
+		return uuid.Nil, fmt.Errorf("%w: %v", ErrBadRequest, err)
 	}
 	i := proto.QueuicItem{
-		Id:   uuid.New(),
-		Item: item,
+		Id:      uuid.New(),
+		Item:    item,
+		Headers: headers,
+	}
+	if err := checkItem(i); err != nil {
+		return uuid.Nil, err
 	}
 	if err := q.Enqueue(i); err != nil {
-		return fmt.Errorf("failed to enqueue item: %v", err)
+		return uuid.Nil, fmt.Errorf("failed to enqueue item: %w", err)
 	}
 	mlog.Debug("enqueued item: %s", item)
+	return i.Id, nil
+}
+
+// Peek peeks up to max items, it returns no items if the queue is empty
+func (s *QueuicServer) Peek(name proto.QueueName, max int) ([]proto.QueuicItem, error) {
+	q, ok := s.getQueue(name)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrQueueNotFound, name)
+	}
+	items, err := q.PeekBatch(max, MAX_BATCH_BYTES)
+	if errors.Is(err, queue.ErrEmpty) {
+		return []proto.QueuicItem{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to peek: %w", err)
+	}
+	return items, nil
+}
+
+func (s *QueuicServer) Accept(name proto.QueueName, id uuid.UUID) error {
+	q, err := s.getInFlight(name, id)
+	if err != nil {
+		return err
+	}
+	if err := q.Accept(id); err != nil {
+		return fmt.Errorf("failed to accept: %w", err)
+	}
 	return nil
 }
 
+func (s *QueuicServer) Release(name proto.QueueName, id uuid.UUID) error {
+	q, err := s.getInFlight(name, id)
+	if err != nil {
+		return err
+	}
+	if err := q.Release(id); err != nil {
+		return fmt.Errorf("failed to release: %w", err)
+	}
+	return nil
+}
+
+func (s *QueuicServer) getInFlight(name proto.QueueName, id uuid.UUID) (*queue.Queue, error) {
+	q, ok := s.getQueue(name)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrQueueNotFound, name)
+	}
+	if !q.InFlight(id) {
+		return nil, fmt.Errorf("%w: %v", ErrItemNotFound, id)
+	}
+	return q, nil
+}
+
+func (s *QueuicServer) QueueOptions(name proto.QueueName) (queue.Options, error) {
+	q, ok := s.getQueue(name)
+	if !ok {
+		return queue.Options{}, fmt.Errorf("%w: %s", ErrQueueNotFound, name)
+	}
+	return q.Options(), nil
+}
+
+func (s *QueuicServer) UpdateQueueOptions(name proto.QueueName, options queue.Options) error {
+	q, ok := s.getQueue(name)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrQueueNotFound, name)
+	}
+	if err := options.Validate(name); err != nil {
+		return fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+	s.setQueueOptions(q, options)
+	mlog.Info("updated options of queue: %s", name)
+	return nil
+}
+
+// PurgeQueue removes the waiting items of the queue, with inFlight
+// also the peeked ones, and keeps its options
+func (s *QueuicServer) PurgeQueue(name proto.QueueName, inFlight bool) (int, error) {
+	q, ok := s.getQueue(name)
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrQueueNotFound, name)
+	}
+	n, err := q.Purge(inFlight)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge queue: %w", err)
+	}
+	mlog.Info("purged %d items from queue: %s", n, name)
+	return n, nil
+}
+
+// MoveFilter selects the items to move, all set fields must match.
+// The zero value selects all waiting items.
+type MoveFilter struct {
+	Ids []uuid.UUID `json:"ids,omitempty"`
+	// Headers must all be set on an item with the same value
+	Headers map[string]string `json:"headers,omitempty"`
+	// Max is the max count of moved items, 0 moves all of them
+	Max int `json:"max,omitempty"`
+}
+
+type MoveRequest struct {
+	Destination proto.QueueName `json:"destination"`
+	MoveFilter
+}
+
+func (f MoveFilter) match(item proto.QueuicItem) bool {
+	if len(f.Ids) > 0 {
+		found := false
+		for _, id := range f.Ids {
+			if id == item.Id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for key, value := range f.Headers {
+		if v, ok := item.Headers[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// MoveItems moves the waiting items of source which match the filter
+// to the end of destination and returns their count, e.g. to redrive a
+// dead letter queue. In flight items are not moved.
+func (s *QueuicServer) MoveItems(source proto.QueueName, destination proto.QueueName, filter MoveFilter) (int, error) {
+	if err := destination.Validate(); err != nil {
+		return 0, fmt.Errorf("%w: invalid destination: %v", ErrBadRequest, err)
+	}
+	if source == destination {
+		return 0, fmt.Errorf("%w: source and destination are the same queue", ErrBadRequest)
+	}
+	if filter.Max < 0 {
+		return 0, fmt.Errorf("%w: max must not be negative", ErrBadRequest)
+	}
+	src, ok := s.getQueue(source)
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrQueueNotFound, source)
+	}
+	dst, ok := s.getQueue(destination)
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrQueueNotFound, destination)
+	}
+	items, err := queue.Move(src, dst, filter.match, filter.Max)
+	if err != nil {
+		return 0, fmt.Errorf("failed to move items: %w", err)
+	}
+	s.events.publishItems(EVENT_MOVE, source, destination, items)
+	return len(items), nil
+}
+
+func (s *QueuicServer) ListQueues() []proto.QueueName {
+	s.queueStore.RLock()
+	defer s.queueStore.RUnlock()
+	names := make([]proto.QueueName, 0, len(s.queueStore.queues))
+	for name := range s.queueStore.queues {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return names[i] < names[j]
+	})
+	return names
+}
+
+func (s *QueuicServer) getQueue(name proto.QueueName) (*queue.Queue, bool) {
+	s.queueStore.RLock()
+	defer s.queueStore.RUnlock()
+	q, ok := s.queueStore.queues[name]
+	return q, ok
+}
+
 func (s *QueuicServer) LoadQueuesFromDisk() error {
 	s.queueStore.Lock()
 	defer s.queueStore.Unlock()
-	path := "./data"
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		if err := os.Mkdir(path, 0755); err != nil {
-			return fmt.Errorf("failed to create data dir: %w", err)
-		}
+	dir := s.dataDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create data dir: %w", err)
 	}
-	files, err := os.ReadDir(path)
+	files, err := os.ReadDir(dir)
 	if err != nil {
 		return fmt.Errorf("failed to read dir: %w", err)
 	}
 	for _, file := range files {
-		if file.IsDir() {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), queue.FILE_EXTENSION) {
+			continue
+		}
+		name, err := proto.NewQueueName(strings.TrimSuffix(file.Name(), queue.FILE_EXTENSION))
+		if err != nil {
+			mlog.Warn("skip file %s: %v", file.Name(), err)
 			continue
 		}
-		name := proto.QueueName{}
-		name.ParseFromString(file.Name())
-		q, err := queue.NewQueue(name)
+		q, err := queue.NewQueueInDir(dir, name)
 		if err != nil {
 			return fmt.Errorf("failed to create queue: %w", err)
 		}
+		s.setQueueOptions(q, s.defaultOptions(name))
+		s.observe(q)
 		mlog.Info("loaded queue: %s", q.Name)
 		s.queueStore.queues[q.Name] = q
 	}
-	return nil
+	// a queue of an interrupted move may have been deleted, it is
+	// created again so that no item of the move is lost
+	return queue.RecoverMoves(dir, func(name proto.QueueName) (*queue.Queue, error) {
+		if q, ok := s.queueStore.queues[name]; ok {
+			return q, nil
+		}
+		return s.createQueue(name, s.defaultOptions(name))
+	})
 }
 
 func (s *QueuicServer) GetStats() []QueueStats {
@@ -133,18 +511,84 @@ func (s *QueuicServer) GetStats() []QueueStats {
 	defer s.queueStore.RUnlock()
 	stats := make([]QueueStats, 0, len(s.queueStore.queues))
 	for _, q := range s.queueStore.queues {
-		stats = append(stats, QueueStats{
-			QueueName: q.Name.String(),
-			Size:      q.Size(),
-			Enequeued: q.Enqueued(),
-			Dequeued:  q.Dequeued(),
-		})
+		stats = append(stats, queueStats(q))
 	}
+	// sorted so that the stats can be paged
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].QueueName < stats[j].QueueName
+	})
 	return stats
 }
 
+func (s *QueuicServer) GetQueueStats(name proto.QueueName) (QueueStats, error) {
+	q, ok := s.getQueue(name)
+	if !ok {
+		return QueueStats{}, fmt.Errorf("%w: %s", ErrQueueNotFound, name)
+	}
+	return queueStats(q), nil
+}
+
+func queueStats(q *queue.Queue) QueueStats {
+	m := q.Metrics()
+	stats := QueueStats{
+		QueueName:      q.Name.String(),
+		Size:           m.Waiting + m.InFlight,
+		Enequeued:      m.Enqueued,
+		Dequeued:       m.Dequeued,
+		EnqueueRate1m:  m.EnqueueRate1m,
+		EnqueueRate5m:  m.EnqueueRate5m,
+		DequeueRate1m:  m.DequeueRate1m,
+		DequeueRate5m:  m.DequeueRate5m,
+		AvgTimeInQueue: m.AvgWait.Seconds(),
+		AvgProcessing:  m.AvgProcessing.Seconds(),
+	}
+	if !m.Oldest.IsZero() {
+		stats.OldestAge = time.Since(m.Oldest).Seconds()
+	}
+	return stats
+}
+
+// BrowsedItem describes an item without its data
+type BrowsedItem struct {
+	Id         string            `json:"id"`
+	Size       int               `json:"size"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	EnqueuedAt time.Time         `json:"enqueued_at"`
+	InFlight   bool              `json:"in_flight"`
+}
+
+type BrowsePage struct {
+	Offset int           `json:"offset"`
+	Total  int           `json:"total"`
+	Items  []BrowsedItem `json:"items"`
+}
+
+// Browse lists up to limit items starting at offset without peeking them
+func (s *QueuicServer) Browse(name proto.QueueName, offset int, limit int) (BrowsePage, error) {
+	if offset < 0 || limit <= 0 || limit > MAX_BROWSE_LIMIT {
+		return BrowsePage{}, fmt.Errorf("%w: offset must not be negative and limit must be between 1 and %d", ErrBadRequest, MAX_BROWSE_LIMIT)
+	}
+	q, ok := s.getQueue(name)
+	if !ok {
+		return BrowsePage{}, fmt.Errorf("%w: %s", ErrQueueNotFound, name)
+	}
+	items, total := q.Browse(offset, limit)
+	page := BrowsePage{Offset: offset, Total: total, Items: make([]BrowsedItem, len(items))}
+	for i, item := range items {
+		page.Items[i] = BrowsedItem{
+			Id:         item.Id.String(),
+			Size:       len(item.Item),
+			Headers:    item.Headers,
+			EnqueuedAt: item.Timestamp,
+			InFlight:   item.InFlight,
+		}
+	}
+	return page, nil
+}
+
+// Serve receives and answers requests until Shutdown is called,
+// then it waits for the requests which are handled and returns nil
 func (s *QueuicServer) Serve() error {
-	s.shutdown = make(chan bool)
 	if s.Key == [32]byte{} {
 		return fmt.Errorf("server has no key source")
 	}
@@ -152,58 +596,241 @@ func (s *QueuicServer) Serve() error {
 		s.Port = DEFAULT_PORT
 	}
 	mlog.Info("receive on port: %d", s.Port)
-	conn, err := net.ListenUDP(NETWORK_TYPE, &net.UDPAddr{Port: s.Port})
+	addr := &net.UDPAddr{Port: s.Port}
+	if s.BindAddress != "" {
+		if addr.IP = net.ParseIP(s.BindAddress); addr.IP == nil {
+			return fmt.Errorf("invalid bind address %q", s.BindAddress)
+		}
+	}
+	conn, err := net.ListenUDP(NETWORK_TYPE, addr)
 	if err != nil {
 		return fmt.Errorf("listen to UDP failed with: %v", err)
 	}
-	defer conn.Close()
-loop:
+	s.mu.Lock()
+	if s.isClosing() {
+		s.mu.Unlock()
+		conn.Close()
+		return ErrServerClosed
+	}
+	served := make(chan struct{})
+	backlog := make(chan packet, s.backlogSize())
+	s.conn, s.served, s.backlog = conn, served, backlog
+	s.mu.Unlock()
+	workers := s.Workers
+	if workers <= 0 {
+		workers = DEFAULT_WORKERS
+	}
+	s.metrics.setWorkers(workers)
+	for i := 0; i < workers; i++ {
+		s.handlers.Add(1)
+		go func() {
+			defer s.handlers.Done()
+			for p := range backlog {
+				s.metrics.working(1)
+				s.servePacket(conn, p.buff, p.remoteAddr, p.received)
+				s.metrics.working(-1)
+			}
+		}()
+	}
+	// the workers answer the packets of the backlog
+	// and write their responses to the connection
+	defer func() {
+		close(backlog)
+		s.handlers.Wait()
+		conn.Close()
+		close(served)
+	}()
 	for {
 		var buff = make([]byte, MAX_PACKET_LENGTH)
 		n, remoteAddr, err := conn.ReadFromUDP(buff[:])
+		if s.isClosing() {
+			mlog.Info("stopped receiving, waiting for the running requests")
+			return nil
+		}
 		if err != nil {
 			mlog.Error("error reading from connection: %v", err)
+			s.metrics.dropped()
 			continue
 		}
-		// breake if we got shutdown signal
+		p := packet{buff[:n], remoteAddr, time.Now()}
 		select {
-		case <-s.shutdown:
-			mlog.Info("shutdown signal received, shutting down")
-			break loop
+		case backlog <- p:
 		default:
-			go func(buff []byte, remoteAddr *net.UDPAddr) {
-				mlog.Debug("received message from %s", remoteAddr)
-				decryptedMessage, err := proto.Decrypt(s.Key[:], buff)
-				if err != nil {
-					mlog.Error("error decrypting message: %v", err)
-					return
-				}
-				resp, err := s.HandleQueuicRequest(decryptedMessage)
-				if err != nil {
-					mlog.Error("error handling request: %v", err)
-					return
-				}
-				encryptedMessage, err := proto.Encrypt(s.Key[:], resp)
-				if err != nil {
-					mlog.Error("error encrypting message: %v", err)
-					return
-				}
-				mlog.Debug("write message back to %s", remoteAddr)
-				_, err = conn.WriteToUDP(encryptedMessage, remoteAddr)
-				if err != nil {
-					mlog.Error("error writing to connection: %v", err)
-				}
-
-			}(append([]byte(nil), buff[:n]...), remoteAddr)
+			s.rejectPacket(conn, p)
 		}
 	}
-	return nil
 }
 
-func (s *QueuicServer) Shutdown() {
-	// TODO Implement graceful shutdown
-	// wait for all onging requests to finish
-	s.shutdown <- true
-	time.Sleep(5 * time.Second)
-	os.Exit(0)
+func (s *QueuicServer) backlogSize() int {
+	if s.Backlog <= 0 {
+		return DEFAULT_BACKLOG
+	}
+	return s.Backlog
+}
+
+// rejectPacket answers a packet with ERR_BUSY when all workers are busy
+// and the backlog is full, the client can send the request again later
+func (s *QueuicServer) rejectPacket(conn *net.UDPConn, p packet) {
+	s.metrics.rejected()
+	s.settings.RLock()
+	key := s.Key
+	s.settings.RUnlock()
+	req, err := proto.Decrypt(key[:], p.buff)
+	if err != nil {
+		s.metrics.decryptFailed()
+		return
+	}
+	mlog.Debug("server is busy, rejected message from %s", p.remoteAddr)
+	resp := errorResponse(req, ErrBusy)
+	if resp == nil {
+		s.metrics.dropped()
+		return
+	}
+	encrypted, err := proto.Encrypt(key[:], resp)
+	if err != nil {
+		s.metrics.dropped()
+		return
+	}
+	if _, err := conn.WriteToUDP(encrypted, p.remoteAddr); err != nil {
+		s.metrics.dropped()
+	}
+}
+
+func (s *QueuicServer) isClosing() bool {
+	select {
+	case <-s.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// servePacket handles a packet received at the given time and writes the response
+func (s *QueuicServer) servePacket(conn *net.UDPConn, buff []byte, remoteAddr *net.UDPAddr, received time.Time) {
+	mlog.Debug("received message from %s", remoteAddr)
+	// the response is encrypted with the key of the request
+	// even if the key is reloaded in between
+	s.settings.RLock()
+	key := s.Key
+	s.settings.RUnlock()
+	decryptedMessage, err := proto.Decrypt(key[:], buff)
+	decrypted := time.Now()
+	if err != nil {
+		mlog.Error("error decrypting message: %v", err)
+		s.metrics.decryptFailed()
+		_, span := s.Tracer.StartAt(context.Background(), "receive", received)
+		span.SetError(err)
+		span.End()
+		return
+	}
+	// the trace context is in the request, so the spans start
+	// when it is known and get the time the packet was received
+	ctx, receive := s.Tracer.StartAt(s.traceContext(decryptedMessage), "receive", received)
+	defer receive.End()
+	receive.SetAttribute("net.peer.addr", remoteAddr.String())
+	if len(decryptedMessage) > 0 {
+		receive.SetAttribute("queuic.command", proto.PacketCommand(decryptedMessage).String())
+	}
+	_, decrypt := s.Tracer.StartAt(ctx, "decrypt", received)
+	decrypt.EndAt(decrypted)
+	resp := s.responses.handle(decryptedMessage, func() []byte {
+		ctx, handle := s.Tracer.Start(ctx, "handle")
+		defer handle.End()
+		start := time.Now()
+		resp, err := s.handleRequest(ctx, decryptedMessage)
+		if len(decryptedMessage) > 0 {
+			s.metrics.observeRequest(proto.PacketCommand(decryptedMessage), time.Since(start))
+		}
+		if err != nil {
+			handle.SetError(err)
+			logRequestError(err)
+			return errorResponse(decryptedMessage, err)
+		}
+		return resp
+	})
+	if resp == nil {
+		s.metrics.dropped()
+		return
+	}
+	encryptedMessage, err := proto.Encrypt(key[:], resp)
+	if err != nil {
+		mlog.Error("error encrypting message: %v", err)
+		s.metrics.dropped()
+		receive.SetError(err)
+		return
+	}
+	mlog.Debug("write message back to %s", remoteAddr)
+	_, err = conn.WriteToUDP(encryptedMessage, remoteAddr)
+	if err != nil {
+		mlog.Error("error writing to connection: %v", err)
+		s.metrics.dropped()
+		receive.SetError(err)
+	}
+}
+
+// traceContext returns a context with the trace context of the item
+// of the request or of the first item of a batch which has one
+func (s *QueuicServer) traceContext(req []byte) context.Context {
+	ctx := context.Background()
+	if s.Tracer == nil {
+		return ctx
+	}
+	q, err := proto.Decode(req)
+	if err != nil {
+		return ctx
+	}
+	if sc, ok := trace.Extract(q.Headers); ok {
+		return trace.ContextWithSpanContext(ctx, sc)
+	}
+	for _, item := range q.Items {
+		if sc, ok := trace.Extract(item.Headers); ok {
+			return trace.ContextWithSpanContext(ctx, sc)
+		}
+	}
+	return ctx
+}
+
+// Shutdown stops receiving requests, waits until the requests which are
+// handled are answered or ctx is done and then closes the queues, so their
+// in flight items are delivered again after a restart.
+func (s *QueuicServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.isClosing() {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	close(s.closing)
+	conn, served := s.conn, s.served
+	s.mu.Unlock()
+	var err error
+	if conn != nil {
+		// unblocks the read of Serve, the connection is closed by Serve
+		// once the responses are written
+		conn.SetReadDeadline(time.Now())
+		select {
+		case <-served:
+		case <-ctx.Done():
+			err = fmt.Errorf("requests are still handled: %w", ctx.Err())
+		}
+	}
+	if closeErr := s.closeQueues(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// closeQueues closes all queues and returns the first error
+func (s *QueuicServer) closeQueues() error {
+	s.queueStore.RLock()
+	defer s.queueStore.RUnlock()
+	var err error
+	for name, q := range s.queueStore.queues {
+		if closeErr := q.Close(); closeErr != nil {
+			mlog.Error("failed to close queue %s: %v", name, closeErr)
+			if err == nil {
+				err = fmt.Errorf("failed to close queue %s: %w", name, closeErr)
+			}
+		}
+	}
+	return err
 }
@@ -1,14 +1,23 @@
 package server_test
 
 import (
+	"context"
 	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/dinifarb/queuic/pkg/proto"
+	"github.com/dinifarb/queuic/pkg/queue"
 	"github.com/dinifarb/queuic/pkg/server"
+	"github.com/dinifarb/queuic/pkg/trace"
 	"github.com/google/uuid"
 )
 
@@ -23,13 +32,13 @@ func TestCreateServerAndEnqueue(t *testing.T) {
 			t.Errorf("server error: %v", err)
 		}
 	}()
-	name := proto.QueueName{}
-	copy(name[:], []byte("test"))
+	// give the server time to bind the port
+	time.Sleep(100 * time.Millisecond)
+	name := proto.QueueName("test")
 	if err := svr.CreateQueue(name); err != nil {
 		t.Errorf("%v", err)
 	}
-	queueName := proto.QueueName{}
-	copy(queueName[:], []byte("test"))
+	queueName := proto.QueueName("test")
 	req := proto.Queuic{
 		Command:   proto.ENQUEUE,
 		QueueName: queueName,
@@ -99,6 +108,171 @@ func TestCreateServerAndEnqueue(t *testing.T) {
 	}
 }
 
+func TestTracePropagation(t *testing.T) {
+	os.Remove("./data/trace.queuic")
+	defer os.Remove("./data/trace.queuic")
+	svr := server.NewQueuicServer("test")
+	svr.Port = server.DEFAULT_PORT + 4
+	spans := &spanRecorder{}
+	svr.Tracer = &trace.Tracer{Exporter: spans}
+	name := proto.QueueName("trace")
+	svr.CreateQueue(name)
+	go svr.Serve()
+	defer svr.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	exchange(t, svr.Port, &proto.Queuic{
+		Command:   proto.ENQUEUE,
+		QueueName: name,
+		QueuicItem: proto.QueuicItem{
+			Id:      uuid.New(),
+			Item:    []byte("traced"),
+			Headers: map[string]string{trace.TRACEPARENT_HEADER: traceparent},
+		},
+	})
+	peeked := exchange(t, svr.Port, &proto.Queuic{Command: proto.PEEK, QueueName: name})
+	if peeked.Headers[trace.TRACEPARENT_HEADER] != traceparent {
+		t.Errorf("peeked item lost its trace context: %v", peeked.Headers)
+	}
+	// the receive span ends after the response is written
+	time.Sleep(50 * time.Millisecond)
+	parent, _ := trace.Parse(traceparent)
+	names := make(map[string]trace.SpanData)
+	for _, span := range spans.get() {
+		if span.Context.TraceID == parent.TraceID {
+			names[span.Name] = span
+		}
+	}
+	if names["receive"].Parent != parent.SpanID || names["receive"].Attributes["queuic.command"] != "ENQUEUE" ||
+		names["decrypt"].Parent != names["receive"].Context.SpanID ||
+		names["handle"].Parent != names["receive"].Context.SpanID ||
+		names["persist"].Parent != names["handle"].Context.SpanID {
+		t.Errorf("unexpected spans of the enqueue: %+v", names)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	os.Remove("./data/metrics.queuic")
+	defer os.Remove("./data/metrics.queuic")
+	svr := server.NewQueuicServer("test")
+	svr.Port = server.DEFAULT_PORT + 3
+	name := proto.QueueName("metrics")
+	svr.CreateQueue(name)
+	go svr.Serve()
+	defer svr.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+
+	exchange(t, svr.Port, &proto.Queuic{Command: proto.ENQUEUE, QueueName: name, QueuicItem: proto.QueuicItem{Id: uuid.New(), Item: []byte("metrics")}})
+	peeked := exchange(t, svr.Port, &proto.Queuic{Command: proto.PEEK, QueueName: name})
+	exchange(t, svr.Port, &proto.Queuic{Command: proto.ACCEPT, QueueName: name, QueuicItem: proto.QueuicItem{Id: peeked.QueuicItem.Id}})
+	var metrics strings.Builder
+	if err := svr.WriteMetrics(&metrics); err != nil {
+		t.Errorf("failed to write metrics: %v", err)
+	}
+	for _, line := range []string{
+		`queuic_queue_depth{queue="metrics"} 0`,
+		`queuic_queue_enqueued_total{queue="metrics"} 1`,
+		`queuic_queue_dequeued_total{queue="metrics"} 1`,
+		`queuic_request_duration_seconds_count{command="PEEK"} 1`,
+		`queuic_decrypt_failures_total 0`,
+	} {
+		if !strings.Contains(metrics.String(), line+"\n") {
+			t.Errorf("metrics are missing %s", line)
+		}
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	os.Remove("./data/evict.queuic")
+	defer os.Remove("./data/evict.queuic")
+	svr := server.NewQueuicServer("test")
+	svr.Port = server.DEFAULT_PORT + 5
+	name := proto.QueueName("evict")
+	svr.CreateQueue(name)
+	go svr.Serve()
+	defer svr.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+
+	// the peek of the empty queue fails, its retry is handled and cached
+	peek := &proto.Queuic{Command: proto.PEEK, RequestId: uuid.New(), QueueName: name}
+	if resp := send(t, svr.Port, peek); resp.Command != proto.ERROR {
+		t.Fatalf("expected an error for the empty queue, got %v", resp.Command)
+	}
+	svr.Enqueue(name, []byte("first"), nil)
+	svr.Enqueue(name, []byte("second"), nil)
+	peeked := exchange(t, svr.Port, peek)
+	// the cache is filled up to its size, the error must not count
+	// as entry and must not evict the cached retry
+	for i := 0; i < server.RESPONSE_CACHE_SIZE-1; i++ {
+		exchange(t, svr.Port, &proto.Queuic{Command: proto.SIZE, RequestId: uuid.New(), QueueName: name})
+	}
+	if resp := exchange(t, svr.Port, peek); resp.QueuicItem.Id != peeked.QueuicItem.Id {
+		t.Errorf("expected the cached response with item %v, got %v", peeked.QueuicItem.Id, resp.QueuicItem.Id)
+	}
+}
+
+// exchange sends the request to the server on port and returns its
+// response, it fails the test if the response is an error
+func exchange(t *testing.T, port int, req *proto.Queuic) *proto.Queuic {
+	t.Helper()
+	resp := send(t, port, req)
+	if resp.Command == proto.ERROR {
+		code, message := proto.DecodeError(resp.QueuicItem.Item)
+		t.Fatalf("%v failed with %v: %s", req.Command, code, message)
+	}
+	return resp
+}
+
+// send sends the request to the server on port and returns its response
+func send(t *testing.T, port int, req *proto.Queuic) *proto.Queuic {
+	t.Helper()
+	reqBytes, err := proto.Encode(req)
+	if err != nil {
+		t.Fatalf("failed to encode request: %v", err)
+	}
+	key := sha256.Sum256([]byte("test"))
+	encrypted, _ := proto.Encrypt(key[:], reqBytes)
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(encrypted)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buff := make([]byte, server.MAX_PACKET_LENGTH)
+	n, err := conn.Read(buff)
+	if err != nil {
+		t.Fatalf("no response to %v: %v", req.Command, err)
+	}
+	decrypted, err := proto.Decrypt(key[:], buff[:n])
+	if err != nil {
+		t.Fatalf("failed to decrypt response: %v", err)
+	}
+	resp, err := proto.Decode(decrypted)
+	if err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	return resp
+}
+
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []trace.SpanData
+}
+
+func (r *spanRecorder) Export(span trace.SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, span)
+}
+
+func (r *spanRecorder) get() []trace.SpanData {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]trace.SpanData(nil), r.spans...)
+}
+
 func sendUdpMessage(send []byte) ([]byte, error) {
 	key := sha256.Sum256([]byte("test"))
 	fmt.Printf("client key: %x\n", key)
@@ -136,3 +310,457 @@ func sendUdpMessage(send []byte) ([]byte, error) {
 		return nil, fmt.Errorf("udp failed")
 	}
 }
+
+func TestBatchRequests(t *testing.T) {
+	fileName := "./data/batch.queuic"
+	if _, err := os.Stat(fileName); !os.IsNotExist(err) {
+		os.Remove(fileName)
+	}
+	svr := server.NewQueuicServer("test")
+	name := proto.QueueName("batch")
+	if err := svr.CreateQueue(name); err != nil {
+		t.Fatalf("%v", err)
+	}
+	items := []proto.QueuicItem{
+		{Id: uuid.New(), Item: []byte("one")},
+		{Id: uuid.New(), Item: []byte("two")},
+		{Id: uuid.New(), Item: []byte("three")},
+	}
+	resp := handle(t, svr, &proto.Queuic{Command: proto.ENQUEUE_BATCH, QueueName: name, Items: items})
+	if resp.Command != proto.ENQUEUE_BATCH_ACK {
+		t.Errorf("unexpected response command: %v", resp.Command)
+	}
+	count := make([]byte, 2)
+	binary.LittleEndian.PutUint16(count, 2)
+	resp = handle(t, svr, &proto.Queuic{
+		Command:    proto.PEEK_BATCH,
+		QueueName:  name,
+		QueuicItem: proto.QueuicItem{Id: uuid.New(), Item: count},
+	})
+	if resp.Command != proto.PEEK_BATCH_ACK {
+		t.Errorf("unexpected response command: %v", resp.Command)
+	}
+	if len(resp.Items) != 2 || string(resp.Items[1].Item) != "two" {
+		t.Errorf("unexpected peeked items: %v", resp.Items)
+	}
+	resp = handle(t, svr, &proto.Queuic{Command: proto.ACCEPT_BATCH, QueueName: name, Items: resp.Items})
+	if resp.Command != proto.ACCEPT_BATCH_ACK {
+		t.Errorf("unexpected response command: %v", resp.Command)
+	}
+	stats := svr.GetStats()
+	if len(stats) != 1 || stats[0].Size != 1 || stats[0].Dequeued != 2 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestSettleNotInFlight(t *testing.T) {
+	os.Remove("./data/settle.queuic")
+	defer os.Remove("./data/settle.queuic")
+	svr := server.NewQueuicServer("test")
+	name := proto.QueueName("settle")
+	if err := svr.CreateQueue(name); err != nil {
+		t.Fatalf("%v", err)
+	}
+	svr.Enqueue(name, []byte("first"), nil)
+	svr.Enqueue(name, []byte("second"), nil)
+	peeked, _ := svr.Peek(name, 2)
+	resp := handle(t, svr, &proto.Queuic{Command: proto.ACCEPT, QueueName: name, QueuicItem: proto.QueuicItem{Id: peeked[0].Id}})
+	if resp.Command != proto.ACCEPT_ACK {
+		t.Errorf("unexpected response command: %v", resp.Command)
+	}
+	// like the http interface an item which is not in flight is not found
+	for _, req := range []*proto.Queuic{
+		{Command: proto.ACCEPT, QueueName: name, QueuicItem: proto.QueuicItem{Id: peeked[0].Id}},
+		{Command: proto.RELEASE, QueueName: name, QueuicItem: proto.QueuicItem{Id: uuid.New()}},
+		{Command: proto.ACCEPT_BATCH, QueueName: name, Items: []proto.QueuicItem{{Id: peeked[1].Id}, {Id: peeked[0].Id}}},
+		{Command: proto.RELEASE_BATCH, QueueName: name, Items: []proto.QueuicItem{{Id: peeked[1].Id}, {Id: uuid.New()}}},
+	} {
+		reqBytes, _ := proto.Encode(req)
+		if _, err := svr.HandleQueuicRequest(reqBytes); !errors.Is(err, server.ErrItemNotFound) {
+			t.Errorf("expected ErrItemNotFound for %v, got %v", req.Command, err)
+		}
+	}
+	// the failed batches did not settle the item which is in flight
+	if err := svr.Accept(name, peeked[1].Id); err != nil {
+		t.Errorf("expected the second item in flight: %v", err)
+	}
+}
+
+func TestEnqueueTooLarge(t *testing.T) {
+	os.Remove("./data/large.queuic")
+	defer os.Remove("./data/large.queuic")
+	svr := server.NewQueuicServer("test")
+	name := proto.QueueName("large")
+	if err := svr.CreateQueue(name); err != nil {
+		t.Fatalf("%v", err)
+	}
+	// the item would not fit in the PEEK_BATCH_ACK of a peek
+	large := proto.QueuicItem{Id: uuid.New(), Item: make([]byte, server.MAX_BATCH_BYTES)}
+	for _, req := range []*proto.Queuic{
+		{Command: proto.ENQUEUE, QueueName: name, QueuicItem: large},
+		{Command: proto.ENQUEUE_BATCH, QueueName: name, Items: []proto.QueuicItem{{Id: uuid.New(), Item: []byte("small")}, large}},
+	} {
+		reqBytes, _ := proto.Encode(req)
+		if _, err := svr.HandleQueuicRequest(reqBytes); !errors.Is(err, server.ErrBadRequest) {
+			t.Errorf("expected ErrBadRequest for %v, got %v", req.Command, err)
+		}
+	}
+	if stats, _ := svr.GetQueueStats(name); stats.Size != 0 {
+		t.Errorf("expected no enqueued items, got %d", stats.Size)
+	}
+}
+
+func TestEnqueueNilId(t *testing.T) {
+	os.Remove("./data/nil-id.queuic")
+	defer os.Remove("./data/nil-id.queuic")
+	svr := server.NewQueuicServer("test")
+	name := proto.QueueName("nil-id")
+	if err := svr.CreateQueue(name); err != nil {
+		t.Fatalf("%v", err)
+	}
+	// a second item with a nil id would be dropped as duplicate
+	for _, req := range []*proto.Queuic{
+		{Command: proto.ENQUEUE, QueueName: name, QueuicItem: proto.QueuicItem{Item: []byte("first")}},
+		{Command: proto.ENQUEUE_BATCH, QueueName: name, Items: []proto.QueuicItem{{Id: uuid.New(), Item: []byte("second")}, {Item: []byte("third")}}},
+	} {
+		reqBytes, _ := proto.Encode(req)
+		if _, err := svr.HandleQueuicRequest(reqBytes); !errors.Is(err, server.ErrBadRequest) {
+			t.Errorf("expected ErrBadRequest for %v, got %v", req.Command, err)
+		}
+	}
+	if stats, _ := svr.GetQueueStats(name); stats.Size != 0 {
+		t.Errorf("expected no enqueued items, got %d", stats.Size)
+	}
+}
+
+func handle(t *testing.T, svr *server.QueuicServer, req *proto.Queuic) *proto.Queuic {
+	t.Helper()
+	reqBytes, err := proto.Encode(req)
+	if err != nil {
+		t.Fatalf("failed to encode request: %v", err)
+	}
+	respBytes, err := svr.HandleQueuicRequest(reqBytes)
+	if err != nil {
+		t.Fatalf("failed to handle request: %v", err)
+	}
+	resp, err := proto.Decode(respBytes)
+	if err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	return resp
+}
+
+func TestQueueManagementRequests(t *testing.T) {
+	fileName := "./data/managed.queuic"
+	if _, err := os.Stat(fileName); !os.IsNotExist(err) {
+		os.Remove(fileName)
+	}
+	svr := server.NewQueuicServer("test")
+	name := proto.QueueName("managed")
+	resp := handle(t, svr, &proto.Queuic{Command: proto.CREATE_QUEUE, QueueName: name})
+	if resp.Command != proto.CREATE_QUEUE_ACK {
+		t.Errorf("unexpected response command: %v", resp.Command)
+	}
+	resp = handle(t, svr, &proto.Queuic{Command: proto.LIST_QUEUES})
+	if len(resp.Items) != 1 || string(resp.Items[0].Item) != "managed" {
+		t.Errorf("unexpected queue list: %v", resp.Items)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := svr.Enqueue(name, []byte("purge me"), nil); err != nil {
+			t.Errorf("%v", err)
+		}
+	}
+	resp = handle(t, svr, &proto.Queuic{Command: proto.STATS, QueueName: name})
+	var stats []server.QueueStats
+	if err := json.Unmarshal(resp.QueuicItem.Item, &stats); err != nil {
+		t.Errorf("failed to unmarshal stats: %v", err)
+	}
+	if len(stats) != 1 || stats[0].Size != 3 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	resp = handle(t, svr, &proto.Queuic{Command: proto.PURGE, QueueName: name})
+	if n := binary.LittleEndian.Uint64(resp.QueuicItem.Item); n != 3 {
+		t.Errorf("expected 3 purged items, got %d", n)
+	}
+	resp = handle(t, svr, &proto.Queuic{Command: proto.DELETE_QUEUE, QueueName: name})
+	if resp.Command != proto.DELETE_QUEUE_ACK {
+		t.Errorf("unexpected response command: %v", resp.Command)
+	}
+	if len(svr.ListQueues()) != 0 {
+		t.Errorf("expected no queues, got %v", svr.ListQueues())
+	}
+}
+
+func TestAutoCreateQueue(t *testing.T) {
+	for _, name := range []string{"tenant-a", "tenant-dlq", "other"} {
+		os.Remove("./data/" + name + ".queuic")
+	}
+	svr := server.NewQueuicServer("test")
+	deadLetter := proto.QueueName("tenant-dlq")
+	svr.AutoCreate = []server.AutoCreateRule{
+		{Pattern: "tenant-dlq"},
+		{Pattern: "tenant-*", Options: queue.Options{MaxLength: 2, TTL: 50 * time.Millisecond, DeadLetter: deadLetter}},
+	}
+	name := proto.QueueName("tenant-a")
+	enqueue := proto.Queuic{
+		Command:    proto.ENQUEUE,
+		QueueName:  name,
+		QueuicItem: proto.QueuicItem{Id: uuid.New(), Item: []byte("expires")},
+	}
+	resp := handle(t, svr, &enqueue)
+	if resp.Command != proto.ENQUEUE_ACK {
+		t.Errorf("unexpected response command: %v", resp.Command)
+	}
+	stats, err := svr.GetQueueStats(name)
+	if err != nil || stats.Size != 1 {
+		t.Errorf("expected auto created queue with 1 item, got %+v, %v", stats, err)
+	}
+	enqueue.QueuicItem.Id = uuid.New()
+	handle(t, svr, &enqueue)
+	enqueue.QueuicItem.Id = uuid.New()
+	reqBytes, _ := proto.Encode(&enqueue)
+	if _, err := svr.HandleQueuicRequest(reqBytes); err == nil {
+		t.Errorf("expected max length error")
+	}
+	other := proto.QueueName("other")
+	reqBytes, _ = proto.Encode(&proto.Queuic{Command: proto.ENQUEUE, QueueName: other, QueuicItem: enqueue.QueuicItem})
+	if _, err := svr.HandleQueuicRequest(reqBytes); err == nil {
+		t.Errorf("expected error for queue without matching rule")
+	}
+	time.Sleep(100 * time.Millisecond)
+	reqBytes, _ = proto.Encode(&proto.Queuic{Command: proto.PEEK, QueueName: name})
+	if _, err := svr.HandleQueuicRequest(reqBytes); err == nil {
+		t.Errorf("expected empty queue after ttl")
+	}
+	stats, err = svr.GetQueueStats(deadLetter)
+	if err != nil || stats.Size != 2 {
+		t.Errorf("expected 2 items in dead letter queue, got %+v, %v", stats, err)
+	}
+	// redrive the expired items, their ids are known to the source
+	move, _ := json.Marshal(server.MoveRequest{Destination: name})
+	resp = handle(t, svr, &proto.Queuic{Command: proto.MOVE, QueueName: deadLetter, QueuicItem: proto.QueuicItem{Id: uuid.New(), Item: move}})
+	if n := binary.LittleEndian.Uint64(resp.QueuicItem.Item); resp.Command != proto.MOVE_ACK || n != 2 {
+		t.Errorf("expected 2 moved items, got %v %d", resp.Command, n)
+	}
+	stats, err = svr.GetQueueStats(name)
+	if err != nil || stats.Size != 2 {
+		t.Errorf("expected 2 redriven items, got %+v, %v", stats, err)
+	}
+}
+
+func TestDeadLetterItself(t *testing.T) {
+	os.Remove("./data/self.queuic")
+	os.Remove("./data/dlq.queuic")
+	defer os.Remove("./data/self.queuic")
+	defer os.Remove("./data/dlq.queuic")
+	svr := server.NewQueuicServer("test")
+	self := queue.Options{TTL: time.Second, DeadLetter: "self"}
+	if err := svr.CreateQueueWithOptions("self", self); !errors.Is(err, server.ErrBadRequest) {
+		t.Errorf("expected ErrBadRequest for a queue as its own dead letter queue, got %v", err)
+	}
+	if err := svr.CreateQueue("self"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := svr.UpdateQueueOptions("self", self); !errors.Is(err, server.ErrBadRequest) {
+		t.Errorf("expected ErrBadRequest for an update to its own dead letter queue, got %v", err)
+	}
+	// the dead letter queue of the defaults is created without it
+	svr.DefaultOptions = queue.Options{TTL: time.Second, DeadLetter: "dlq"}
+	if err := svr.CreateQueue("dlq"); err != nil {
+		t.Fatalf("failed to create the dead letter queue of the defaults: %v", err)
+	}
+	if options, _ := svr.QueueOptions("dlq"); options.DeadLetter != "" {
+		t.Errorf("expected no dead letter queue, got %s", options.DeadLetter)
+	}
+}
+
+func TestDeadLetterFull(t *testing.T) {
+	for _, name := range []string{"expiring", "full-dlq"} {
+		os.Remove("./data/" + name + ".queuic")
+		defer os.Remove("./data/" + name + ".queuic")
+	}
+	svr := server.NewQueuicServer("test")
+	svr.CreateQueueWithOptions("full-dlq", queue.Options{MaxLength: 1})
+	svr.Enqueue("full-dlq", []byte("dead"), nil)
+	svr.CreateQueueWithOptions("expiring", queue.Options{TTL: 50 * time.Millisecond, DeadLetter: "full-dlq"})
+	svr.Enqueue("expiring", []byte("first"), nil)
+	svr.Enqueue("expiring", []byte("second"), nil)
+	time.Sleep(100 * time.Millisecond)
+	// the full dead letter queue rejects the expired items, so
+	// the source keeps them instead of dropping them
+	items, err := svr.Peek("expiring", 1)
+	if err != nil || len(items) != 1 || string(items[0].Item) != "first" {
+		t.Errorf("expected the first kept item, got %v, %v", items, err)
+	}
+	if stats, _ := svr.GetQueueStats("expiring"); stats.Size != 2 {
+		t.Errorf("expected 2 items in the source queue, got %d", stats.Size)
+	}
+	if stats, _ := svr.GetQueueStats("full-dlq"); stats.Size != 1 {
+		t.Errorf("expected 1 item in the dead letter queue, got %d", stats.Size)
+	}
+	// once the dead letter queue has room the expired item is moved
+	dead, _ := svr.Peek("full-dlq", 1)
+	svr.Accept("full-dlq", dead[0].Id)
+	if _, err := svr.Peek("expiring", 1); err != nil {
+		t.Errorf("failed to peek: %v", err)
+	}
+	if stats, _ := svr.GetQueueStats("full-dlq"); stats.Size != 1 {
+		t.Errorf("expected the expired item in the dead letter queue, got %d items", stats.Size)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	svr := server.NewQueuicServer("test")
+	svr.Port = server.DEFAULT_PORT + 1
+	if err := svr.CreateQueue("shutdown"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.Remove("./data/shutdown.queuic")
+	served := make(chan error, 1)
+	go func() {
+		served <- svr.Serve()
+	}()
+	// give the server time to bind the port
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := svr.Shutdown(ctx); err != nil {
+		t.Errorf("failed to shut down: %v", err)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("expected Serve to return nil, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Serve did not return after shutdown")
+	}
+	if _, err := svr.Enqueue("shutdown", []byte("late"), nil); !errors.Is(err, queue.ErrClosed) {
+		t.Errorf("expected closed queue after shutdown, got %v", err)
+	}
+	if err := svr.Serve(); !errors.Is(err, server.ErrServerClosed) {
+		t.Errorf("expected ErrServerClosed from Serve after shutdown, got %v", err)
+	}
+}
+
+func TestReconcileQueues(t *testing.T) {
+	for _, name := range []string{"defined", "changed", "unmanaged"} {
+		os.Remove("./data/" + name + ".queuic")
+		defer os.Remove("./data/" + name + ".queuic")
+	}
+	svr := server.NewQueuicServer("test")
+	svr.CreateQueue("changed")
+	svr.CreateQueue("unmanaged")
+	svr.Queues = []server.QueueDefinition{
+		{Name: "defined", Options: queue.Options{MaxLength: 10}},
+		{Name: "changed", Options: queue.Options{TTL: time.Hour, DeadLetter: "defined"}},
+	}
+	if err := svr.ReconcileQueues(); err != nil {
+		t.Fatalf("failed to reconcile: %v", err)
+	}
+	for _, def := range svr.Queues {
+		if options, err := svr.QueueOptions(def.Name); err != nil || options != def.Options {
+			t.Errorf("expected options %+v of queue %s, got %+v: %v", def.Options, def.Name, options, err)
+		}
+	}
+	if options, err := svr.QueueOptions("unmanaged"); err != nil || options != (queue.Options{}) {
+		t.Errorf("unmanaged queue changed to %+v: %v", options, err)
+	}
+	svr.Queues = append(svr.Queues, server.QueueDefinition{Name: "invalid name"})
+	if err := svr.ReconcileQueues(); !errors.Is(err, server.ErrBadRequest) {
+		t.Errorf("expected bad request for invalid name, got %v", err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	for _, name := range []string{"reload", "reloaded"} {
+		os.Remove("./data/" + name + ".queuic")
+		defer os.Remove("./data/" + name + ".queuic")
+	}
+	svr := server.NewQueuicServer("test")
+	svr.CreateQueue("reload")
+	svr.Enqueue("reload", []byte("in flight"), nil)
+	peeked, err := svr.Peek("reload", 1)
+	if err != nil || len(peeked) != 1 {
+		t.Fatalf("failed to peek: %v", err)
+	}
+	err = svr.Reload(server.Settings{
+		Key: "reloaded",
+		Queues: []server.QueueDefinition{
+			{Name: "reload", Options: queue.Options{MaxLength: 5}},
+			{Name: "reloaded"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to reload: %v", err)
+	}
+	if svr.Key != sha256.Sum256([]byte("reloaded")) {
+		t.Errorf("key was not replaced")
+	}
+	if options, _ := svr.QueueOptions("reload"); options.MaxLength != 5 {
+		t.Errorf("options were not reloaded: %+v", options)
+	}
+	if _, err := svr.GetQueueStats("reloaded"); err != nil {
+		t.Errorf("defined queue was not created: %v", err)
+	}
+	if err := svr.Accept("reload", peeked[0].Id); err != nil {
+		t.Errorf("peeked item is not in flight after reload: %v", err)
+	}
+}
+
+func TestBusy(t *testing.T) {
+	os.Remove("./data/busy.queuic")
+	defer os.Remove("./data/busy.queuic")
+	svr := server.NewQueuicServer("test")
+	svr.Port = server.DEFAULT_PORT + 2
+	svr.Workers = 1
+	svr.Backlog = 1
+	svr.CreateQueue("busy")
+	go svr.Serve()
+	defer svr.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+
+	key := sha256.Sum256([]byte("test"))
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: svr.Port})
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	// a burst of enqueues saturates the single worker
+	const burst = 200
+	for i := 0; i < burst; i++ {
+		req, _ := proto.Encode(&proto.Queuic{Command: proto.ENQUEUE, QueueName: "busy", QueuicItem: proto.QueuicItem{Id: uuid.New(), Item: []byte("burst")}})
+		encrypted, _ := proto.Encrypt(key[:], req)
+		conn.Write(encrypted)
+	}
+	acked, busy := 0, 0
+	buff := make([]byte, server.MAX_PACKET_LENGTH)
+	for acked+busy < burst {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buff)
+		if err != nil {
+			break
+		}
+		decrypted, _ := proto.Decrypt(key[:], buff[:n])
+		resp, _ := proto.Decode(decrypted)
+		switch resp.Command {
+		case proto.ENQUEUE_ACK:
+			acked++
+		case proto.ERROR:
+			if code, _ := proto.DecodeError(resp.QueuicItem.Item); code == proto.ERR_BUSY {
+				busy++
+			}
+		}
+	}
+	if acked == 0 || busy == 0 {
+		t.Errorf("expected acked and busy responses, got %d acked and %d busy", acked, busy)
+	}
+	if stats, _ := svr.GetQueueStats("busy"); stats.Size != acked {
+		t.Errorf("expected %d items, busy requests must not be handled, got %d", acked, stats.Size)
+	}
+	var metrics strings.Builder
+	svr.WriteMetrics(&metrics)
+	if !strings.Contains(metrics.String(), fmt.Sprintf("queuic_rejected_requests_total %d\n", busy)) {
+		t.Errorf("expected %d rejected requests in metrics:\n%s", busy, metrics.String())
+	}
+}
@@ -0,0 +1,317 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dinifarb/mlog"
+)
+
+const (
+	DEFAULT_OTLP_ENDPOINT = "http://localhost:4318/v1/traces"
+	// spans are sent when the batch is full or after the interval
+	EXPORT_BATCH_SIZE = 512
+	EXPORT_INTERVAL   = 5 * time.Second
+	// spans which don't fit in the queue of the exporter are dropped
+	EXPORT_QUEUE_SIZE = 4096
+	EXPORT_TIMEOUT    = 10 * time.Second
+	// OTLP status code of a failed span
+	STATUS_CODE_ERROR = 2
+)
+
+// OTLPExporter sends the spans as OTLP/HTTP json to a collector
+type OTLPExporter struct {
+	Endpoint    string
+	ServiceName string
+	Client      *http.Client
+	spans       chan SpanData
+	flush       chan chan struct{}
+	dropped     uint64
+}
+
+func NewOTLPExporter(endpoint string, serviceName string) *OTLPExporter {
+	if endpoint == "" {
+		endpoint = DEFAULT_OTLP_ENDPOINT
+	}
+	e := &OTLPExporter{
+		Endpoint:    endpoint,
+		ServiceName: serviceName,
+		Client:      &http.Client{Timeout: EXPORT_TIMEOUT},
+		spans:       make(chan SpanData, EXPORT_QUEUE_SIZE),
+		flush:       make(chan chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+func (e *OTLPExporter) Export(span SpanData) {
+	select {
+	case e.spans <- span:
+	default:
+		atomic.AddUint64(&e.dropped, 1)
+	}
+}
+
+// Dropped returns the count of spans dropped because the queue was full
+func (e *OTLPExporter) Dropped() uint64 {
+	return atomic.LoadUint64(&e.dropped)
+}
+
+// Flush sends the queued spans and waits until they are sent
+func (e *OTLPExporter) Flush(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case e.flush <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *OTLPExporter) run() {
+	ticker := time.NewTicker(EXPORT_INTERVAL)
+	defer ticker.Stop()
+	batch := make([]SpanData, 0, EXPORT_BATCH_SIZE)
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.send(batch); err != nil {
+			mlog.Error("failed to export %d spans: %v", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case span := <-e.spans:
+			batch = append(batch, span)
+			if len(batch) == EXPORT_BATCH_SIZE {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case done := <-e.flush:
+			for len(e.spans) > 0 {
+				batch = append(batch, <-e.spans)
+				if len(batch) == EXPORT_BATCH_SIZE {
+					send()
+				}
+			}
+			send()
+			close(done)
+		}
+	}
+}
+
+func (e *OTLPExporter) send(spans []SpanData) error {
+	body, err := json.Marshal(encodeOTLP(e.ServiceName, spans))
+	if err != nil {
+		return err
+	}
+	resp, err := e.Client.Post(e.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// the json encoding of the OTLP trace export request
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func encodeOTLP(serviceName string, spans []SpanData) otlpRequest {
+	encoded := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		span := otlpSpan{
+			TraceId:           s.Context.TraceID.String(),
+			SpanId:            s.Context.SpanID.String(),
+			Name:              s.Name,
+			StartTimeUnixNano: strconv.FormatInt(s.StartTime.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.EndTime.UnixNano(), 10),
+			Attributes:        encodeAttributes(s.Attributes),
+		}
+		if s.Parent != (SpanID{}) {
+			span.ParentSpanId = s.Parent.String()
+		}
+		if s.Error != "" {
+			span.Status = &otlpStatus{Code: STATUS_CODE_ERROR, Message: s.Error}
+		}
+		encoded[i] = span
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: encodeAttributes(map[string]string{"service.name": serviceName})},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "queuic"},
+			Spans: encoded,
+		}},
+	}}}
+}
+
+func encodeAttributes(attributes map[string]string) []otlpAttribute {
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	encoded := make([]otlpAttribute, len(keys))
+	for i, k := range keys {
+		encoded[i] = otlpAttribute{Key: k, Value: otlpValue{StringValue: attributes[k]}}
+	}
+	return encoded
+}
+
+// Collector is a stand-in for an OTLP collector which receives the
+// OTLP/HTTP json of an OTLPExporter, e.g. to look at spans locally
+type Collector struct {
+	// OnSpan is called with every received span
+	OnSpan func(span SpanData)
+	mu     sync.Mutex
+	spans  []SpanData
+}
+
+// Spans returns the received spans
+func (c *Collector) Spans() []SpanData {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]SpanData(nil), c.spans...)
+}
+
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req otlpRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	spans, err := decodeOTLP(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	c.spans = append(c.spans, spans...)
+	c.mu.Unlock()
+	if c.OnSpan != nil {
+		for _, span := range spans {
+			c.OnSpan(span)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("{}"))
+}
+
+func decodeOTLP(req otlpRequest) ([]SpanData, error) {
+	spans := make([]SpanData, 0)
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			for _, s := range ss.Spans {
+				span := SpanData{Name: s.Name, Context: SpanContext{Sampled: true}}
+				if err := decodeHex(span.Context.TraceID[:], s.TraceId); err != nil {
+					return nil, fmt.Errorf("invalid trace id of span %s: %v", s.Name, err)
+				}
+				if err := decodeHex(span.Context.SpanID[:], s.SpanId); err != nil {
+					return nil, fmt.Errorf("invalid span id of span %s: %v", s.Name, err)
+				}
+				if s.ParentSpanId != "" {
+					if err := decodeHex(span.Parent[:], s.ParentSpanId); err != nil {
+						return nil, fmt.Errorf("invalid parent span id of span %s: %v", s.Name, err)
+					}
+				}
+				start, err := strconv.ParseInt(s.StartTimeUnixNano, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid start time of span %s: %v", s.Name, err)
+				}
+				end, err := strconv.ParseInt(s.EndTimeUnixNano, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid end time of span %s: %v", s.Name, err)
+				}
+				span.StartTime, span.EndTime = time.Unix(0, start), time.Unix(0, end)
+				if len(s.Attributes) > 0 {
+					span.Attributes = make(map[string]string, len(s.Attributes))
+					for _, a := range s.Attributes {
+						span.Attributes[a.Key] = a.Value.StringValue
+					}
+				}
+				if s.Status != nil && s.Status.Code == STATUS_CODE_ERROR {
+					span.Error = s.Status.Message
+				}
+				spans = append(spans, span)
+			}
+		}
+	}
+	return spans, nil
+}
+
+func decodeHex(dst []byte, s string) error {
+	if hex.DecodedLen(len(s)) != len(dst) {
+		return fmt.Errorf("%q must have %d hex digits", s, 2*len(dst))
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err
+}
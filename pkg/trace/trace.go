@@ -0,0 +1,232 @@
+// Package trace propagates W3C trace contexts in the headers of items
+// and records spans which can be exported to an OTLP collector.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// TRACEPARENT_HEADER is the item header of the W3C trace context,
+	// e.g. 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+	TRACEPARENT_HEADER = "traceparent"
+	TRACEPARENT_LENGTH = 55
+)
+
+type TraceID [16]byte
+
+type SpanID [8]byte
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// SpanContext identifies a span across process boundaries
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// String returns the span context in the traceparent format
+func (sc SpanContext) String() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// Parse parses a traceparent header of version 00
+func Parse(traceparent string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(traceparent, "-")
+	if len(traceparent) != TRACEPARENT_LENGTH || len(parts) != 4 || parts[0] != "00" {
+		return sc, fmt.Errorf("invalid traceparent %q", traceparent)
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, fmt.Errorf("invalid trace id of traceparent %q: %v", traceparent, err)
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, fmt.Errorf("invalid span id of traceparent %q: %v", traceparent, err)
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return sc, fmt.Errorf("invalid flags of traceparent %q: %v", traceparent, err)
+	}
+	if !sc.IsValid() {
+		return sc, fmt.Errorf("traceparent %q has a zero id", traceparent)
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, nil
+}
+
+type contextKey struct{}
+
+// ContextWithSpanContext returns a context whose spans are children of sc
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, contextKey{}, sc)
+}
+
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(contextKey{}).(SpanContext)
+	return sc, ok && sc.IsValid()
+}
+
+// Inject returns the headers with the traceparent of the span of ctx.
+// The headers are copied and an existing traceparent is kept.
+func Inject(ctx context.Context, headers map[string]string) map[string]string {
+	sc, ok := SpanContextFromContext(ctx)
+	if !ok {
+		return headers
+	}
+	if _, ok := headers[TRACEPARENT_HEADER]; ok {
+		return headers
+	}
+	injected := make(map[string]string, len(headers)+1)
+	for k, v := range headers {
+		injected[k] = v
+	}
+	injected[TRACEPARENT_HEADER] = sc.String()
+	return injected
+}
+
+// Extract returns the span context of the traceparent header
+func Extract(headers map[string]string) (SpanContext, bool) {
+	traceparent, ok := headers[TRACEPARENT_HEADER]
+	if !ok {
+		return SpanContext{}, false
+	}
+	sc, err := Parse(traceparent)
+	return sc, err == nil
+}
+
+// Exporter receives the ended spans, Export must not block
+type Exporter interface {
+	Export(span SpanData)
+}
+
+// Tracer starts spans and passes them to its exporter when they end,
+// a nil Tracer records nothing.
+type Tracer struct {
+	Exporter Exporter
+}
+
+// SpanData is an ended span
+type SpanData struct {
+	Name       string
+	Context    SpanContext
+	Parent     SpanID
+	StartTime  time.Time
+	EndTime    time.Time
+	Attributes map[string]string
+	// Error is the message of the error which failed the span
+	Error string
+}
+
+// Span is a running span, the methods of a nil Span do nothing
+type Span struct {
+	mu     sync.Mutex
+	data   SpanData
+	tracer *Tracer
+	ended  bool
+}
+
+// Start starts a span which is a child of the span of ctx
+// and returns a context with the new span
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	return t.StartAt(ctx, name, time.Now())
+}
+
+// StartAt starts a span at the given time, e.g. when the
+// parent of the span is known only after it started
+func (t *Tracer) StartAt(ctx context.Context, name string, start time.Time) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	span := &Span{data: SpanData{Name: name, StartTime: start}, tracer: t}
+	sc := &span.data.Context
+	if parent, ok := SpanContextFromContext(ctx); ok {
+		sc.TraceID = parent.TraceID
+		sc.Sampled = parent.Sampled
+		span.data.Parent = parent.SpanID
+	} else {
+		rand.Read(sc.TraceID[:])
+		sc.Sampled = true
+	}
+	rand.Read(sc.SpanID[:])
+	return ContextWithSpanContext(ctx, *sc), span
+}
+
+// Context returns the span context of the span,
+// the zero SpanContext for a nil Span
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.data.Context
+}
+
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	if s.data.Attributes == nil {
+		s.data.Attributes = make(map[string]string)
+	}
+	s.data.Attributes[key] = value
+}
+
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.ended {
+		s.data.Error = err.Error()
+	}
+}
+
+func (s *Span) End() {
+	s.EndAt(time.Now())
+}
+
+// EndAt ends the span at the given time and exports it,
+// only the first call has an effect
+func (s *Span) EndAt(end time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.EndTime = end
+	data := s.data
+	s.mu.Unlock()
+	if s.tracer.Exporter != nil && data.Context.Sampled {
+		s.tracer.Exporter.Export(data)
+	}
+}
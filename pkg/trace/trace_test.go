@@ -0,0 +1,66 @@
+package trace_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dinifarb/queuic/pkg/trace"
+)
+
+func TestParseAndInject(t *testing.T) {
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := trace.Parse(traceparent)
+	if err != nil || !sc.Sampled || sc.String() != traceparent {
+		t.Errorf("unexpected span context %v of %s: %v", sc, traceparent, err)
+	}
+	for _, invalid := range []string{"", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902bx-01"} {
+		if _, err := trace.Parse(invalid); err == nil {
+			t.Errorf("expected error for traceparent %q", invalid)
+		}
+	}
+	headers := map[string]string{"content-type": "text/plain"}
+	if injected := trace.Inject(context.Background(), headers); len(injected) != 1 {
+		t.Errorf("context without span added headers: %v", injected)
+	}
+	ctx := trace.ContextWithSpanContext(context.Background(), sc)
+	injected := trace.Inject(ctx, headers)
+	if injected[trace.TRACEPARENT_HEADER] != traceparent || len(headers) != 1 {
+		t.Errorf("unexpected injected headers %v, given headers %v", injected, headers)
+	}
+	if extracted, ok := trace.Extract(injected); !ok || extracted != sc {
+		t.Errorf("extracted %v instead of %v", extracted, sc)
+	}
+}
+
+func TestExportToCollector(t *testing.T) {
+	collector := &trace.Collector{}
+	ts := httptest.NewServer(collector)
+	defer ts.Close()
+	exporter := trace.NewOTLPExporter(ts.URL, "test")
+	tracer := &trace.Tracer{Exporter: exporter}
+	ctx, parent := tracer.Start(context.Background(), "parent")
+	_, child := tracer.Start(ctx, "child")
+	child.SetAttribute("queue", "orders")
+	child.SetError(context.Canceled)
+	child.End()
+	parent.End()
+	flushCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := exporter.Flush(flushCtx); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	spans := collector.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	c, p := spans[0], spans[1]
+	if c.Name != "child" || p.Name != "parent" || c.Context.TraceID != p.Context.TraceID || c.Parent != p.Context.SpanID {
+		t.Errorf("child %+v is not a child of %+v", c, p)
+	}
+	if c.Attributes["queue"] != "orders" || c.Error != context.Canceled.Error() || c.EndTime.Before(c.StartTime) {
+		t.Errorf("unexpected child %+v", c)
+	}
+}